@@ -0,0 +1,185 @@
+// Golang support for LLSN - Allyst's data interchange format.
+// LLSN specification http://allyst.org/opensource/llsn/
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// copyright (C) 2015 Allyst Inc. http://allyst.com
+// author Taras Halturin <halturin@allyst.com>
+
+package bench
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	llsn "github.com/allyst/go-llsn"
+)
+
+// codec encodes and decodes the payloads
+type codec struct {
+	name   string
+	encode func(v interface{}) ([]byte, error)
+	decode func(b []byte, v interface{}) error
+}
+
+var codecs = []codec{
+	{"LLSN", encodeLLSN, decodeLLSN},
+	{"LLSN-chan", encodeLLSNChan, decodeLLSNChan},
+	{"gob", encodeGob, decodeGob},
+	{"JSON", json.Marshal, json.Unmarshal},
+}
+
+func encodeLLSN(v interface{}) (b []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	buffer := llsn.Encode(v)
+	defer llsn.Release(buffer)
+
+	return append([]byte{}, buffer.Bytes()...), nil
+}
+
+// decodeLLSN decodes the copy of 'b' (decoder modifies the source)
+func decodeLLSN(b []byte, v interface{}) error {
+	return llsn.Decode(append([]byte{}, b...), v)
+}
+
+func encodeLLSNChan(v interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+
+	channel := make(chan []byte)
+	failure := make(chan interface{}, 1)
+
+	go func() {
+		// llsn.Encode closes the channel even if it fails
+		defer func() { failure <- recover() }()
+		llsn.Encode(v, channel)
+	}()
+
+	for b := range channel {
+		buffer.Write(b)
+	}
+
+	if r := <-failure; r != nil {
+		return nil, fmt.Errorf("%v", r)
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// decodeLLSNChan sends 'b' to the decoder by chunks of 4K
+func decodeLLSNChan(b []byte, v interface{}) error {
+	channel := make(chan []byte, 16)
+
+	go func() {
+		for k := 0; k < len(b); k += 4096 {
+			channel <- append([]byte{}, b[k:min(k+4096, len(b))]...)
+		}
+		close(channel)
+	}()
+
+	return llsn.Decode(channel, v)
+}
+
+func encodeGob(v interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(v)
+	return buffer.Bytes(), err
+}
+
+func decodeGob(b []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
+
+func BenchmarkEncode(b *testing.B) {
+	for _, p := range Payloads() {
+		for _, c := range codecs {
+			b.Run(p.Name+"/"+c.name, func(b *testing.B) {
+				data, err := c.encode(p.Value)
+				if err != nil {
+					b.Skipf("%s can't encode %s: %v", c.name, p.Name, err)
+				}
+
+				b.ReportAllocs()
+				b.SetBytes(int64(len(data)))
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					c.encode(p.Value)
+				}
+
+				b.ReportMetric(float64(len(data)), "bytes/msg")
+			})
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	for _, p := range Payloads() {
+		for _, c := range codecs {
+			b.Run(p.Name+"/"+c.name, func(b *testing.B) {
+				data, err := c.encode(p.Value)
+				if err != nil {
+					b.Skipf("%s can't encode %s: %v", c.name, p.Name, err)
+				}
+				if err := c.decode(data, p.New()); err != nil {
+					b.Fatalf("%s can't decode %s: %v", c.name, p.Name, err)
+				}
+
+				b.ReportAllocs()
+				b.SetBytes(int64(len(data)))
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					c.decode(data, p.New())
+				}
+
+				b.ReportMetric(float64(len(data)), "bytes/msg")
+			})
+		}
+	}
+}
+
+// TestPayloads checks that every codec decodes the payloads it encodes
+func TestPayloads(t *testing.T) {
+	for _, p := range Payloads() {
+		for _, c := range codecs {
+			data, err := c.encode(p.Value)
+			if err != nil {
+				continue
+			}
+
+			v := p.New()
+			if err := c.decode(data, v); err != nil {
+				t.Fatalf("%s/%s: %v", p.Name, c.name, err)
+			}
+
+			again, err := c.encode(v)
+			if err != nil || !bytes.Equal(data, again) {
+				t.Fatalf("%s/%s: decoded value is encoded differently (%v)", p.Name, c.name, err)
+			}
+		}
+	}
+}
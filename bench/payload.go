@@ -0,0 +1,169 @@
+// Golang support for LLSN - Allyst's data interchange format.
+// LLSN specification http://allyst.org/opensource/llsn/
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// copyright (C) 2015 Allyst Inc. http://allyst.com
+// author Taras Halturin <halturin@allyst.com>
+
+// Package bench compares LLSN with encoding/gob and encoding/json on the
+// payloads of typical shapes. The payloads are the regular Go values, every
+// codec encodes the same value.
+//
+//	go test -bench . -benchmem ./bench
+//
+// Besides ns/op, B/op and allocs/op every benchmark reports the encoded size
+// of payload (bytes/msg). The benchmark is skipped if the codec can't encode
+// the payload (gob doesn't encode nil items of slice). protobuf isn't
+// compared, the module has no dependencies.
+package bench
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	llsn "github.com/allyst/go-llsn"
+)
+
+// Record is the flat record of scalar fields
+type Record struct {
+	ID       int64
+	Account  uint64
+	Name     string
+	Email    string
+	Balance  float64
+	Active   bool
+	Created  time.Time
+	Country  string
+	Score    int64
+	Rating   float64
+	Verified bool
+	Tags     int64
+}
+
+// Node is the level of deep nesting
+type Node struct {
+	Depth int64
+	Name  string
+	Child *Node
+}
+
+// Document has a large blob
+type Document struct {
+	Name    string
+	Type    string
+	Content llsn.Blob
+}
+
+// Words is the list of small strings
+type Words struct {
+	Words []string
+}
+
+// Item is the element of array of nullable structs
+type Item struct {
+	SKU      string
+	Quantity int64
+	Price    float64
+	Parent   *Item
+}
+
+// Order has the array of nullable structs
+type Order struct {
+	ID    int64
+	Items []*Item
+}
+
+// Payload is the named value of benchmark
+type Payload struct {
+	Name  string
+	Value interface{}        // pointer to the value
+	New   func() interface{} // returns the pointer to the new value to decode into
+}
+
+// Payloads returns the payloads of benchmarks
+func Payloads() []Payload {
+	return []Payload{
+		{"Flat", flat(), func() interface{} { return new([]Record) }},
+		{"Deep", deep(64), func() interface{} { return new(Node) }},
+		{"Blob", blob(1 << 20), func() interface{} { return new(Document) }},
+		{"Strings", words(10000), func() interface{} { return new(Words) }},
+		{"Nullable", order(1000), func() interface{} { return new(Order) }},
+	}
+}
+
+func flat() *[]Record {
+	created := time.Date(2015, time.April, 15, 16, 56, 39, 678000000, time.UTC)
+	records := make([]Record, 100)
+
+	for i := range records {
+		records[i] = Record{int64(i), uint64(i) * 1000003, fmt.Sprintf("user %d", i),
+			fmt.Sprintf("user%d@example.com", i), float64(i) * 10.25, i%2 == 0,
+			created.Add(time.Duration(i) * time.Hour), "US", int64(i * 7), 4.5,
+			i%3 == 0, int64(i % 5)}
+	}
+
+	return &records
+}
+
+func deep(depth int) *Node {
+	var n *Node
+
+	for i := depth; i > 0; i-- {
+		n = &Node{int64(i), fmt.Sprintf("level %d", i), n}
+	}
+
+	return n
+}
+
+func blob(size int) *Document {
+	content := make(llsn.Blob, size)
+	for i := range content {
+		content[i] = byte(i * 31)
+	}
+
+	return &Document{"report.bin", "application/octet-stream", content}
+}
+
+func words(n int) *Words {
+	w := &Words{make([]string, n)}
+	for i := range w.Words {
+		w.Words[i] = strings.Repeat("w", i%12+1)
+	}
+
+	return w
+}
+
+// order returns the order of 'n' items, every third item is nil
+func order(n int) *Order {
+	o := &Order{ID: 42, Items: make([]*Item, n)}
+
+	for i := range o.Items {
+		if i%3 == 2 {
+			continue
+		}
+		o.Items[i] = &Item{fmt.Sprintf("SKU-%06d", i), int64(i%10 + 1), float64(i) + 0.99, nil}
+		if i%3 == 1 {
+			o.Items[i].Parent = o.Items[i-1]
+		}
+	}
+
+	return o
+}
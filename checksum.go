@@ -0,0 +1,180 @@
+// Golang support for LLSN - Allyst's data interchange format.
+// LLSN specification http://allyst.org/opensource/llsn/
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// copyright (C) 2015 Allyst Inc. http://allyst.com
+// author Taras Halturin <halturin@allyst.com>
+
+package llsn
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// With "checksum" option the packet has the header of version 2 with
+// flag_checksum and the trailer follows the tailed data:
+//
+// 4B   : CRC32C (Castagnoli) of header, fields and tailed data (big-endian)
+//
+// the index (see "index" option) follows the checksum. The compressed packet
+// is checksummed as is. The packet of '[]byte' is verified before decoding,
+// the others - after.
+//
+// With "digest" option (flag_digest) every file data are followed by the
+// SHA-256 digest (32 bytes), which is computed while the file is read and
+// verified while it's written to the disk. The length of file doesn't
+// include the digest.
+//
+// Decoder returns *ErrorLLSN with ERR_CHECKSUM code on mismatch.
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// encodeChecksum runs 'encode' (the body of packet) and writes the checksum
+// of 'header' and the body
+func encodeChecksum(w io.Writer, header []byte, encode func(io.Writer)) {
+	if s, ok := w.(*sizeWriter); ok {
+		// the size is counted only
+		encode(s)
+		s.Write(make([]byte, crc32.Size))
+		return
+	}
+
+	h := crc32.New(crc32c)
+	h.Write(header)
+
+	encode(hashWriter{w, h})
+
+	w.Write(h.Sum(nil))
+}
+
+// checksum starts the checksum of the data read after the 'header'. The
+// buffer of '[]byte' is verified at once
+func (b *decodeBuffer) checksum(header []byte) {
+	if b.channel == nil && b.reader == nil {
+		verifyChecksum(header, b.buffer)
+		return
+	}
+
+	b.crc = crc32.New(crc32c)
+	b.crc.Write(header)
+
+	read := b.read
+	b.read = func(n uint64) []byte {
+		buff := read(n)
+		b.crc.Write(buff)
+		return buff
+	}
+
+	// the skipped data are read to be checksummed
+	b.skip = nil
+}
+
+// verifyChecksum checks the packet of 'header' and the rest of data 'bin'
+func verifyChecksum(header []byte, bin []byte) {
+	end := len(bin)
+
+	// the index follows the checksum
+	if end >= 12 && string(bin[end-4:]) == index_magic {
+		offset := binary.BigEndian.Uint64(bin[end-12:]) - uint64(len(header))
+		if offset < uint64(end) {
+			end = int(offset)
+		}
+	}
+
+	if end < 4 {
+		oops(ERR_CHECKSUM, "packet")
+	}
+
+	sum := crc32.Update(crc32.Checksum(header, crc32c), crc32c, bin[:end-4])
+	if binary.BigEndian.Uint32(bin[end-4:end]) != sum {
+		oops(ERR_CHECKSUM, "packet")
+	}
+}
+
+// decodeChecksum reads the checksum trailer and compares it with the
+// checksum of data read. the rest of compressed stream is read before
+func decodeChecksum(buffer *decodeBuffer) {
+	if buffer.crc == nil {
+		return
+	}
+
+	if buffer.raw != nil {
+		if _, err := io.Copy(io.Discard, buffer.reader); err != nil {
+			panic(err)
+		}
+	}
+
+	sum := buffer.crc.Sum32()
+	trailer := make([]byte, 4)
+
+	if buffer.raw != nil {
+		if _, err := io.ReadFull(buffer.raw, trailer); err != nil {
+			panic(err)
+		}
+	} else {
+		copy(trailer, buffer.read(4))
+	}
+
+	if binary.BigEndian.Uint32(trailer) != sum {
+		oops(ERR_CHECKSUM, "packet")
+	}
+}
+
+// hashReader passes the data read from the compressed packet to the hash.
+// it's io.ByteReader, so the decompressors don't read ahead the trailer
+type hashReader struct {
+	r *bufio.Reader
+	h hash.Hash32
+}
+
+func (r hashReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.h.Write(p[:n])
+	return n, err
+}
+
+func (r hashReader) ReadByte() (byte, error) {
+	c, err := r.r.ReadByte()
+	if err == nil {
+		r.h.Write([]byte{c})
+	}
+	return c, err
+}
+
+// digestSize returns the length of file digest of the packet
+func (b *decodeBuffer) digestSize() uint64 {
+	if b.digests {
+		return sha256.Size
+	}
+	return 0
+}
+
+// verifyDigest reads the digest of file and compares it with 'sum'
+func verifyDigest(buffer *decodeBuffer, sum []byte, name string) {
+	if !bytes.Equal(buffer.read(sha256.Size), sum) {
+		oops(ERR_CHECKSUM, "file "+name)
+	}
+}
@@ -0,0 +1,171 @@
+// Golang support for LLSN - Allyst's data interchange format.
+// LLSN specification http://allyst.org/opensource/llsn/
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// copyright (C) 2015 Allyst Inc. http://allyst.com
+// author Taras Halturin <halturin@allyst.com>
+
+package llsn
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// Codec is the typed encoder/decoder of T. The type is checked and the
+// layout of its fields is resolved once by NewCodec, so the misuse is found
+// before the first packet. The types of values are written once per packet,
+// so the types tree is built by every call. The options (threshold, date mode
+// etc.) are read on every call, like Encode does.
+type Codec[T any] struct {
+	t      reflect.Type
+	layout *structInfo // see packetLayout
+}
+
+// codecs of types. [0] - regular, [1] - with "flatten" option
+var codecs [2]sync.Map // reflect.Type -> codec
+
+// NewCodec checks the type T and all of the types it refers to
+func NewCodec[T any]() (c *Codec[T], err error) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+
+	cache := &codecs[0]
+	if flatten {
+		cache = &codecs[1]
+	}
+
+	if c, ok := cache.Load(t); ok {
+		return c.(*Codec[T]), nil
+	}
+
+	defer recoverEncode(&err)
+
+	if err := checkType(t, map[reflect.Type]bool{}); err != nil {
+		return nil, err
+	}
+
+	v, _ := cache.LoadOrStore(t, &Codec[T]{t: t, layout: packetLayout(t)})
+	return v.(*Codec[T]), nil
+}
+
+// Marshal encodes 'v'
+func (c *Codec[T]) Marshal(v *T) (b []byte, err error) {
+	if v == nil {
+		return nil, errors.New("Incorrect value (nil)")
+	}
+
+	defer recoverEncode(&err)
+
+	value := reflect.ValueOf(v).Elem()
+	return encodeBytes(func(w io.Writer) {
+		encodePacket(value, c.layout, w, threshold, canonical)
+	}), nil
+}
+
+// Unmarshal decodes the packet 'b' into the new value of T. Like Decode, it
+// modifies 'b'
+func (c *Codec[T]) Unmarshal(b []byte) (v T, err error) {
+	err = Decode(b, &v)
+	return v, err
+}
+
+// UnmarshalTo decodes the packet 'b' into 'v'
+func (c *Codec[T]) UnmarshalTo(b []byte, v *T) error {
+	if v == nil {
+		return errors.New("Incorrect destination (nil)")
+	}
+
+	return Decode(b, v)
+}
+
+// Marshal encodes 'v' with the cached Codec of T
+func Marshal[T any](v *T) ([]byte, error) {
+	c, err := NewCodec[T]()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Marshal(v)
+}
+
+// Unmarshal decodes the packet 'b' with the cached Codec of T
+func Unmarshal[T any](b []byte) (T, error) {
+	c, err := NewCodec[T]()
+	if err != nil {
+		var v T
+		return v, err
+	}
+
+	return c.Unmarshal(b)
+}
+
+// checkType returns the error if the type 't' (or any type it refers to)
+// can't be encoded. panics if the field IDs are inconsistent
+func checkType(t reflect.Type, seen map[reflect.Type]bool) error {
+	if seen[t] {
+		return nil
+	}
+	seen[t] = true
+
+	if lookupExt(t) != nil {
+		return nil
+	}
+
+	switch t {
+	case blobType, dateType, fileType, bignumberType, bigfloatType, valueType:
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Array, reflect.Slice:
+		return checkType(t.Elem(), seen)
+
+	case reflect.Struct:
+		if t.Implements(streamerType) {
+			return checkType(reflect.Zero(t).Interface().(streamer).elemType(), seen)
+		}
+
+		for _, f := range getStructInfo(t).fields {
+			if err := checkType(f.t, seen); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map, reflect.Chan, reflect.Func, reflect.Complex64,
+		reflect.Complex128, reflect.Uintptr, reflect.UnsafePointer:
+		return fmt.Errorf("unsupported type for LLSN encoding: %s", t)
+	}
+
+	return nil
+}
+
+// recoverEncode turns the panic of encoder into the error
+func recoverEncode(err *error) {
+	if r := recover(); r != nil {
+		if e, ok := r.(error); ok {
+			*err = e
+			return
+		}
+		*err = fmt.Errorf("%v", r)
+	}
+}
@@ -42,9 +42,19 @@ const (
 	type_struct    = 8
 	type_array     = 9
 
-	type_arrayn  = 10
-	type_pointer = 11
-	type_unumber = 12
+	type_arrayn    = 10
+	type_pointer   = 11
+	type_unumber   = 12
+	type_ndate     = 13
+	type_bignumber = 14
+	type_bigfloat  = 15
+	type_ext       = 16
+	type_interface = 17
+	type_structid  = 18
+	type_stream    = 19
+
+	// the last type code. the codes above are the null types
+	type_last = type_stream
 
 	type_undefined_null = 255
 	type_number_null    = 254
@@ -56,16 +66,61 @@ const (
 	type_bool_null      = 248
 	type_struct_null    = 247
 
-	type_array_null   = 246
-	type_arrayn_null  = 245
-	type_pointer_null = 244
-	type_unumber_null = 243
+	type_array_null     = 246
+	type_arrayn_null    = 245
+	type_pointer_null   = 244
+	type_unumber_null   = 243
+	type_ndate_null     = 242
+	type_bignumber_null = 241
+	type_bigfloat_null  = 240
+	type_ext_null       = 239
+	type_interface_null = 238
+	type_structid_null  = 237
+
+	// reserved values of the float scale byte (see EncodeFloat)
+	float_scale_ext = 0x80
+	float_nan       = 0x81
+	float_inf       = 0x82
+	float_ninf      = 0x83
+	float_nzero     = 0x84
+
+	float_scale_min = -123
+	float_scale_max = 127
+
+	// form of the big float value (see EncodeBigFloat)
+	bigfloat_zero   = 0
+	bigfloat_finite = 1
+	bigfloat_inf    = 2
+
+	// types of the generic Value
+	TYPE_NUMBER    = type_number
+	TYPE_FLOAT     = type_float
+	TYPE_STRING    = type_string
+	TYPE_BLOB      = type_blob
+	TYPE_FILE      = type_file
+	TYPE_DATE      = type_date
+	TYPE_BOOL      = type_bool
+	TYPE_STRUCT    = type_struct
+	TYPE_ARRAY     = type_array
+	TYPE_ARRAYN    = type_arrayn
+	TYPE_UNUMBER   = type_unumber
+	TYPE_NDATE     = type_ndate
+	TYPE_BIGNUMBER = type_bignumber
+	TYPE_BIGFLOAT  = type_bigfloat
+	TYPE_EXT       = type_ext
+	TYPE_INTERFACE = type_interface
+	TYPE_STRUCTID  = type_structid
+	TYPE_STREAM    = type_stream
 
 	// huge data threshold (STRING, BLOB, FILE)
 	// if set to 0 - tail encoding is disable
 	// if set > 0 - data exeeds this value are placed to the end of binary packet
 	DEFAULT_THRESHOLD = 0
 
+	// size of the chunks sent to the channel by Encode(v, channel)
+	// if set to 1 - every fragment of data is sent as it's encoded
+	DEFAULT_CHUNK = 4096
+
 	// max length for the types STRING/BLOB
 	STRING_MAXBYTES = 10485760
 	BLOB_MAXBYTES   = 4294967296
@@ -73,8 +128,34 @@ const (
 	// temporary folder for decoding files
 	DECODE_FOLDER = "/tmp/"
 
+	// date encoding modes
+	// DATE_COMPACT - 8 bytes, milliseconds and the fixed offset (hours, minutes)
+	// DATE_LOSSLESS - nanoseconds and the offset in seconds
+	// DATE_ZONE - DATE_LOSSLESS with the IANA zone name
+	DATE_COMPACT  = 0
+	DATE_LOSSLESS = 1
+	DATE_ZONE     = 2
+
+	// max number of elements in the chunk of Stream
+	STREAM_CHUNK = 1024
+
 	// version of encoder
 	VERSION = 1
+	// version of the packets with extended header (see compress.go)
+	VERSION2 = 2
+
+	// flags of the extended header
+	flag_compressed = 0x01
+	flag_checksum   = 0x02
+	flag_digest     = 0x04
+	// the type codes of version 2 (see typeFlags)
+	flag_lossless = 0x08 // type_ndate, type_bignumber, type_bigfloat
+	flag_ext      = 0x10 // type_ext, type_interface
+	flag_structid = 0x20
+	flag_stream   = 0x40
+	flag_index    = 0x80 // the index trailer follows the packet
+
+	flags_types = flag_lossless | flag_ext | flag_structid | flag_stream
 )
 
 type File struct {
@@ -117,8 +198,9 @@ func (f *File) SaveTo(path string) error {
 type Blob []byte
 
 type typesTree struct {
-	ttype int    // encode type
-	n     uint64 // number of fields of struct
+	ttype int      // encode type
+	n     uint64   // number of fields of struct
+	ids   []uint64 // field IDs of struct (type_structid)
 
 	parent *typesTree
 	child  *typesTree
@@ -133,19 +215,35 @@ type stackElement struct {
 	value     reflect.Value
 	index     func(int) reflect.Value
 	nullflags []byte
+	mask      maskFunc     // selected items (decoding). nil - all
+	stream    *streamLevel // stream level state. nil - not a stream
+}
+
+// pushStack sets the first of 'free' elements to 'e' and returns it. popped
+// elements are reused, so the stack of decoder grows with no allocation
+func pushStack(free **stackElement, e stackElement) *stackElement {
+	s := *free
+	if s == nil {
+		s = new(stackElement)
+	} else {
+		*free = s.parent
+	}
+
+	*s = e
+	return s
 }
 
 func (t *typesTree) append(previous_type int) *typesTree {
 	t.ttype = previous_type
 	if t.next == nil {
-		t.next = &typesTree{type_undefined, 0, t.parent, nil, t, nil}
+		t.next = &typesTree{ttype: type_undefined, parent: t.parent, prev: t}
 	}
 	return t.next
 }
 
 func (t *typesTree) addchild(parent_type int) *typesTree {
 	t.ttype = parent_type
-	t.child = &typesTree{type_undefined, 0, t, nil, nil, nil}
+	t.child = &typesTree{ttype: type_undefined, parent: t}
 	t.append(t.ttype) // just add 'next' item
 	return t.child
 }
@@ -156,7 +254,14 @@ type tailElement struct {
 	length uint64        // len of tailed data
 }
 
+// append adds the tailed data of 'v'. the data of consecutive skipped values
+// (invalid 'v') are skipped at once
 func (t_current *tailElement) append(v reflect.Value, l uint64) *tailElement {
+	if !v.IsValid() && !t_current.value.IsValid() && t_current.length > 0 {
+		t_current.length += l
+		return t_current
+	}
+
 	n := &tailElement{nil, v, l}
 	t_current.next = n
 	return n
@@ -167,6 +272,15 @@ const (
 	valueDECODED = false
 )
 
+// encodeOpts are the options of packet being encoded
+type encodeOpts struct {
+	canonical bool // see "canonical" option
+	digests   bool // file data are followed by the digest
+	sizing    bool // the packet is counted by Size
+	legacy    bool // version 1 is pinned. see encodingExt
+	v1        bool // the header of version 1. see encodeFloatV1
+}
+
 type decodeOpts struct {
 	threshold  uint16
 	stack      *stackElement
@@ -175,15 +289,32 @@ type decodeOpts struct {
 	tail_first *tailElement
 }
 
+// error codes
+const (
+	ERR_UNREGISTERED_TYPE = 100
+	ERR_FIELDS_MISMATCH   = 101
+	ERR_TYPE_MISMATCH     = 102
+	ERR_NOT_FOUND         = 103
+	ERR_CHECKSUM          = 104
+)
+
 var errorLLSNlist = map[int]string{
-	100: "blabla blablabla",
+	ERR_UNREGISTERED_TYPE: "Unregistered type name",
+	ERR_FIELDS_MISMATCH:   "Number of fields mismatch",
+	ERR_TYPE_MISMATCH:     "Type mismatch",
+	ERR_NOT_FOUND:         "Path not found",
+	ERR_CHECKSUM:          "Checksum mismatch",
 }
 
 type ErrorLLSN struct {
-	code int
+	code    int
+	details string
 }
 
 func (e *ErrorLLSN) Error() string {
+	if e.details != "" {
+		return errorLLSNlist[e.code] + " (" + e.details + ")"
+	}
 	return errorLLSNlist[e.code]
 }
 
@@ -191,6 +322,10 @@ func (e *ErrorLLSN) Code() int {
 	return e.code
 }
 
-func oops(code int) {
-	panic(&ErrorLLSN{code})
+func oops(code int, details ...string) {
+	e := &ErrorLLSN{code: code}
+	if len(details) > 0 {
+		e.details = details[0]
+	}
+	panic(e)
 }
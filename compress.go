@@ -0,0 +1,180 @@
+// Golang support for LLSN - Allyst's data interchange format.
+// LLSN specification http://allyst.org/opensource/llsn/
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// copyright (C) 2015 Allyst Inc. http://allyst.com
+// author Taras Halturin <halturin@allyst.com>
+
+package llsn
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// The packet is compressed if "compress" option is set. Compressed packet
+// has the header of version 2:
+//
+// 2B   : version (4 bits) = 2, threshold (12 bits)
+// 1B   : flags. flag_compressed
+// 1B   : compressor ID
+// ...  : compressed body (number of fields, fields and tailed data)
+//
+// The body is compressed and decompressed as the stream, so the huge files
+// are never kept in memory. The "index" option is ignored for the compressed
+// packets.
+
+// IDs of the built-in compressors. IDs 1..63 are reserved
+const (
+	COMPRESS_NONE    = 0
+	COMPRESS_GZIP    = 1
+	COMPRESS_DEFLATE = 2
+)
+
+// Compressor provides the streams compressing and decompressing the body of
+// packet. The reader shouldn't read ahead the end of stream if the source is
+// io.ByteReader (the checksum trailer follows the compressed body)
+type Compressor interface {
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var compressors = struct {
+	sync.RWMutex
+	ids map[uint8]Compressor
+}{
+	ids: make(map[uint8]Compressor),
+}
+
+// RegisterCompressor binds the compressor 'c' to the 'id'. Panics if the ID
+// is already registered.
+func RegisterCompressor(id uint8, c Compressor) {
+	if id == COMPRESS_NONE {
+		panic("compressor ID should be greater than 0")
+	}
+
+	compressors.Lock()
+	defer compressors.Unlock()
+
+	if _, exist := compressors.ids[id]; exist {
+		panic(fmt.Sprintf("compressor ID %d is already registered", id))
+	}
+
+	compressors.ids[id] = c
+}
+
+func lookupCompressor(id uint8) Compressor {
+	compressors.RLock()
+	defer compressors.RUnlock()
+	return compressors.ids[id]
+}
+
+// channelReader reads the data of decodeBuffer received from the channel
+type channelReader struct {
+	b *decodeBuffer
+}
+
+func (c channelReader) Read(p []byte) (int, error) {
+	for len(c.b.buffer) == 0 {
+		select {
+		case buffer, ok := <-c.b.channel:
+			if !ok {
+				return 0, io.EOF
+			}
+			c.b.buffer = buffer
+
+		case <-time.After(1 * time.Minute):
+			return 0, errors.New("Read channel timeout")
+		}
+	}
+
+	n := copy(p, c.b.buffer)
+	c.b.buffer = c.b.buffer[n:]
+	return n, nil
+}
+
+// decompress makes the buffer read the rest of source via the decompressor
+func (b *decodeBuffer) decompress(c Compressor) {
+	var source io.Reader
+
+	switch {
+	case b.reader != nil:
+		b.raw = b.reader
+	case b.channel != nil:
+		b.raw = bufio.NewReader(channelReader{b})
+	default:
+		b.raw = bufio.NewReader(bytes.NewReader(b.buffer))
+	}
+
+	source = b.raw
+	if b.crc != nil {
+		source = hashReader{b.raw, b.crc}
+	}
+
+	r, err := c.NewReader(source)
+	if err != nil {
+		panic(err)
+	}
+
+	b.reader = bufio.NewReader(r)
+	b.at = nil
+	b.read = b.read_reader
+	b.look = b.look_reader
+	b.skip = nil
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// the checksum trailer follows the stream
+	zr.Multistream(false)
+	return zr, nil
+}
+
+type deflateCompressor struct{}
+
+func (deflateCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, flate.DefaultCompression)
+}
+
+func (deflateCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+func init() {
+	RegisterCompressor(COMPRESS_GZIP, gzipCompressor{})
+	RegisterCompressor(COMPRESS_DEFLATE, deflateCompressor{})
+}
@@ -0,0 +1,427 @@
+// Golang support for LLSN - Allyst's data interchange format.
+// LLSN specification http://allyst.org/opensource/llsn/
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// copyright (C) 2015 Allyst Inc. http://allyst.com
+// author Taras Halturin <halturin@allyst.com>
+
+package llsn_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	llsn "github.com/allyst/go-llsn"
+)
+
+// Conformance vectors are the packets (testdata/conformance/*.llsn) with the
+// JSON descriptions of their content (*.json). The Go values of vectors are
+// encoded and compared with the packets, the packets are decoded and
+// compared with the descriptions. See testdata/README for the format of
+// descriptions.
+//
+// go test -run TestLLSN_conformance -update
+//
+// rewrites the vectors (make generate-test-pbs)
+
+var update = flag.Bool("update", false, "rewrite the conformance vectors")
+
+const vectorsDir = "testdata/conformance/"
+
+type conformanceVector struct {
+	name        string
+	description string
+	threshold   int
+	datemode    int
+	version     int // pinned version of header
+	value       interface{}
+}
+
+// vectorFile is the JSON description of vector
+type vectorFile struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	Packet      string        `json:"packet"`
+	Threshold   int           `json:"threshold"`
+	Fields      []*vectorNode `json:"fields"`
+}
+
+// vectorNode is the decoded value. null item of array is JSON null
+type vectorNode struct {
+	Type  string          `json:"type"`
+	Null  bool            `json:"null,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+	Zone  string          `json:"zone,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Items []*vectorNode   `json:"items,omitempty"`
+}
+
+var vectorTypes = map[int]string{
+	llsn.TYPE_NUMBER:    "number",
+	llsn.TYPE_FLOAT:     "float",
+	llsn.TYPE_STRING:    "string",
+	llsn.TYPE_BLOB:      "blob",
+	llsn.TYPE_FILE:      "file",
+	llsn.TYPE_DATE:      "date",
+	llsn.TYPE_BOOL:      "bool",
+	llsn.TYPE_STRUCT:    "struct",
+	llsn.TYPE_ARRAY:     "array",
+	llsn.TYPE_ARRAYN:    "arrayn",
+	llsn.TYPE_UNUMBER:   "unumber",
+	llsn.TYPE_NDATE:     "ndate",
+	llsn.TYPE_BIGNUMBER: "bignumber",
+	llsn.TYPE_BIGFLOAT:  "bigfloat",
+}
+
+type VectorPoint struct {
+	X, Y int64
+	Next *VectorPoint
+}
+
+type VectorEmpty struct{}
+
+func conformanceVectors() []conformanceVector {
+	var (
+		i64  int64   = -1
+		u64  uint64  = 1
+		f64  float64 = 0.5
+		str          = "nullable"
+		flag         = true
+		date         = time.Date(2015, time.April, 15, 16, 56, 39, 678000000, time.FixedZone("", -(3*3600+30*60)))
+	)
+
+	return []conformanceVector{
+		{name: "number", description: "NUMBER of every length (1..9 bytes), nullable NUMBER",
+			value: struct {
+				A, B, C, D, E, F, G, H, I, J int64
+				Null, Set                    *int64
+			}{0, -64, 63, 64, -8192, 1048576, -134217728, 17179869184,
+				math.MinInt64, math.MaxInt64, nil, &i64}},
+
+		{name: "unumber", description: "UNUMBER of every length (1..9 bytes), nullable UNUMBER",
+			value: struct {
+				A, B, C, D, E, F uint64
+				Null, Set        *uint64
+			}{0, 127, 128, 16384, 72057594037927936, math.MaxUint64, nil, &u64}},
+
+		{name: "float", description: "FLOAT of float64 and float32, the special values, nullable FLOAT",
+			version: llsn.VERSION2,
+			value: struct {
+				A, B, C, D, E, F, G float64
+				H                   float32
+				Null, Set           *float64
+			}{3.141596, -0.1, 1e300, 5e-324, math.Copysign(0, -1), math.Inf(1), math.NaN(),
+				1.5, nil, &f64}},
+
+		{name: "float_v1", description: "FLOAT of the header of version 1 (unsigned scale)",
+			value: struct {
+				A, B, C, D, E, F float64
+				G                float32
+			}{3.141596, -0.1, 1000, -1e18, math.Copysign(0, -1), 1e-200, 0.1}},
+
+		{name: "string", description: "STRING: empty, ASCII, UTF-8, nullable STRING",
+			value: struct {
+				A, B, C   string
+				Null, Set *string
+			}{"", "Hello World.", "你好世界. مرحبا بالعالم. Привет Мир.", nil, &str}},
+
+		{name: "blob", description: "BLOB and null BLOB",
+			value: struct {
+				A, B llsn.Blob
+				Null llsn.Blob
+			}{llsn.Blob{0, 1, 2, 255}, llsn.Blob{}, nil}},
+
+		{name: "file", description: "FILE and null FILE",
+			value: struct {
+				A    llsn.File
+				Null *llsn.File
+			}{llsn.File{Name: vectorsDir + "file.txt"}, nil}},
+
+		{name: "date", description: "DATE (compact form) and null DATE",
+			value: struct {
+				A, B time.Time
+				Null *time.Time
+				Set  *time.Time
+			}{date, time.Date(1900, time.January, 1, 0, 0, 0, 0, time.UTC), nil, &date}},
+
+		{name: "ndate", description: "NDATE (lossless form with zone name) and null NDATE",
+			datemode: llsn.DATE_ZONE,
+			value: struct {
+				A, B time.Time
+				Null *time.Time
+			}{time.Date(2015, time.April, 15, 16, 56, 39, 678901234, time.FixedZone("CEST", 2*3600)),
+				time.Date(1900, time.January, 1, 0, 0, 0, 0, time.UTC), nil}},
+
+		{name: "bool", description: "BOOL and null BOOL",
+			value: struct {
+				A, B      bool
+				Null, Set *bool
+			}{true, false, nil, &flag}},
+
+		{name: "struct", description: "nested STRUCT, struct with no fields, null STRUCT",
+			value: struct {
+				A     VectorPoint
+				B     VectorEmpty
+				Null  *VectorPoint
+				Items [3]VectorPoint
+			}{VectorPoint{1, 2, &VectorPoint{3, 4, nil}}, VectorEmpty{}, nil,
+				[3]VectorPoint{{5, 6, nil}, {7, 8, &VectorPoint{9, 10, nil}}, {}}}},
+
+		{name: "array", description: "ARRAY of scalars, structs and arrays, empty and null ARRAY",
+			value: struct {
+				A    []int64
+				B    [3]bool
+				C    []string
+				D    [][]uint64
+				E    []VectorPoint
+				F    []float64
+				Null []int64
+			}{[]int64{1, -1, 1000}, [3]bool{true, false, true}, []string{"a", "", "c"},
+				[][]uint64{{1}, {}, {2, 3}}, []VectorPoint{{1, 2, nil}, {3, 4, nil}},
+				[]float64{}, nil}},
+
+		{name: "arrayn", description: "ARRAYN (array with null items), nested nullable arrays, null ARRAYN",
+			value: struct {
+				A    []*int64
+				B    [][]*VectorPoint
+				C    []*string
+				Null []*int64
+			}{[]*int64{nil, &i64, nil, nil, nil, nil, nil, nil, nil, &i64},
+				[][]*VectorPoint{nil, nil, {nil, nil, {27, 0, nil}, nil, nil}, nil, {nil, {29, 0, nil}}},
+				[]*string{&str, nil}, nil}},
+
+		{name: "big", description: "BIGNUMBER and BIGFLOAT",
+			value: struct {
+				A, B  *big.Int
+				C     *big.Float
+				Null  *big.Int
+				NullF *big.Float
+			}{big.NewInt(-1), new(big.Int).Lsh(big.NewInt(1), 100), big.NewFloat(-2.5), nil, nil}},
+
+		{name: "tail", description: "threshold 8: strings, blobs and files longer than 8 bytes are in the tail",
+			threshold: 8,
+			value: struct {
+				A    string
+				B    string
+				C    llsn.Blob
+				D    []string
+				E    llsn.File
+				F    *string
+				Last int64
+			}{"short", "the long string", llsn.Blob{1, 2, 3, 4, 5, 6, 7, 8, 9},
+				[]string{"long item 1", "item", "long item 2"},
+				llsn.File{Name: vectorsDir + "file.txt"}, &str, 1}},
+
+		{name: "threshold_max", description: "the max threshold (4095)",
+			threshold: 4095,
+			value: struct {
+				A string
+				B llsn.Blob
+			}{string(bytes.Repeat([]byte("a"), 4096)), llsn.Blob(bytes.Repeat([]byte{1}, 4095))}},
+
+		{name: "scalar", description: "top level scalar value is the packet of single field",
+			value: "single field"},
+
+		{name: "top_array", description: "top level array is the packet of single field",
+			value: []*int64{&i64, nil}},
+	}
+}
+
+// describe returns the node of the decoded value
+func describe(t *testing.T, v llsn.Value) *vectorNode {
+	if v.Type == 0 {
+		// null item of array
+		return nil
+	}
+
+	n := &vectorNode{Type: vectorTypes[v.Type]}
+	if n.Type == "" {
+		t.Fatalf("unexpected type %d", v.Type)
+	}
+
+	if v.IsNull() {
+		n.Null = true
+		return n
+	}
+
+	raw := func(x interface{}) json.RawMessage {
+		b, err := json.Marshal(x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	switch d := v.Data.(type) {
+	case nil:
+		// struct, array
+		n.Items = make([]*vectorNode, len(v.Items))
+		for i, item := range v.Items {
+			n.Items[i] = describe(t, item)
+		}
+	case int64:
+		n.Value = raw(strconv.FormatInt(d, 10))
+	case uint64:
+		n.Value = raw(strconv.FormatUint(d, 10))
+	case float64:
+		n.Value = raw(strconv.FormatFloat(d, 'g', -1, 64))
+	case bool, string:
+		n.Value = raw(d)
+	case llsn.Blob:
+		n.Value = raw(hex.EncodeToString(d))
+	case time.Time:
+		n.Value = raw(d.Format(time.RFC3339Nano))
+		if v.Type == llsn.TYPE_NDATE {
+			n.Zone, _ = d.Zone()
+		}
+	case *big.Int:
+		n.Value = raw(d.String())
+	case *big.Float:
+		n.Value = raw(d.Text('g', -1))
+	case *llsn.File:
+		dir := t.TempDir() + "/"
+		os.MkdirAll(filepath.Dir(dir+d.Name), 0700)
+		if err := d.SaveTo(dir); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(dir + d.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.Name = d.Name
+		n.Value = raw(hex.EncodeToString(data))
+	default:
+		t.Fatalf("unexpected data %T", d)
+	}
+
+	return n
+}
+
+// covered marks the type codes of node 'n'
+func covered(codes map[string]bool, n *vectorNode) {
+	if n == nil {
+		return
+	}
+	if n.Null {
+		codes[n.Type+"_null"] = true
+	} else {
+		codes[n.Type] = true
+	}
+	for _, item := range n.Items {
+		covered(codes, item)
+	}
+}
+
+func TestLLSN_conformance(t *testing.T) {
+	llsn.SetOption("dir", t.TempDir()+"/")
+	defer llsn.SetOption("dir", llsn.DECODE_FOLDER)
+
+	codes := map[string]bool{}
+
+	for _, v := range conformanceVectors() {
+		packet := vectorsDir + v.name + ".llsn"
+		description := vectorsDir + v.name + ".json"
+
+		llsn.SetOption("threshold", v.threshold)
+		llsn.SetOption("date", v.datemode)
+		llsn.SetOption("version", v.version)
+		b := llsn.Encode(v.value).Bytes()
+		llsn.SetOption("threshold", 0)
+		llsn.SetOption("date", llsn.DATE_COMPACT)
+		llsn.SetOption("version", 0)
+
+		if *update {
+			if err := os.WriteFile(packet, b, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		golden, err := os.ReadFile(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, golden) {
+			t.Fatalf("%s: encoded %v, expected %v", v.name, b, golden)
+		}
+
+		// decode the packet field by field into the generic Value
+		d, err := llsn.NewDecoder(golden)
+		if err != nil {
+			t.Fatalf("%s: %v", v.name, err)
+		}
+
+		var fields []llsn.Value
+		for d.More() {
+			var field llsn.Value
+			if err := d.Decode(&field); err != nil {
+				t.Fatalf("%s: %v", v.name, err)
+			}
+			fields = append(fields, field)
+		}
+
+		// tailed data are read with the last field
+		vf := vectorFile{Name: v.name, Description: v.description,
+			Packet: v.name + ".llsn", Threshold: v.threshold}
+		for _, field := range fields {
+			n := describe(t, field)
+			covered(codes, n)
+			vf.Fields = append(vf.Fields, n)
+		}
+
+		js, err := json.MarshalIndent(&vf, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		js = append(js, '\n')
+
+		if *update {
+			if err := os.WriteFile(description, js, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		expected, err := os.ReadFile(description)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(js, expected) {
+			t.Fatalf("%s: decoded\n%s\nexpected\n%s", v.name, js, expected)
+		}
+	}
+
+	// every type code of the specification (type_pointer is reserved)
+	for _, name := range vectorTypes {
+		if !codes[name] || !codes[name+"_null"] {
+			t.Fatalf("type %q isn't covered (null: %v)", name, codes[name+"_null"])
+		}
+	}
+
+	fmt.Printf("TestLLSN_conformance: PASSED\n")
+}
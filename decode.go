@@ -25,41 +25,213 @@
 package llsn
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
 	"io/ioutil"
 	"math"
+	"math/big"
+	"os"
 	"reflect"
+	"strconv"
+	"sync"
 	"time"
 )
 
-func decode_ext(buffer *decodeBuffer, value *reflect.Value) {
-	var value_type int
-
-	var stack *stackElement = &stackElement{}
-	var tt *typesTree = &typesTree{}
+func decode_ext(buffer *decodeBuffer, value *reflect.Value, mask *fieldMask) {
 	var tail *tailElement = &tailElement{}
-	var tail_first *tailElement = tail
-	var version uint8
 
+	n := decodeHeader(buffer)
+
+	switch {
+	case value.Type() == valueType && n != 1:
+		// generic value gets the fields of packet as the items of struct
+		value.FieldByName("Type").SetInt(type_struct)
+		decode_loop(buffer, n, makeItems(value.FieldByName("Items"), n, nil), tail, nil)
+
+	case !isRecord(value.Type()):
+		// array or scalar value is encoded as the single field
+		if n != 1 {
+			oops(ERR_FIELDS_MISMATCH, fmt.Sprintf("%s is the single field, received %d",
+				value.Type(), n))
+		}
+		if t := int(buffer.look(1)[0]); !compatible(value.Type(), t) {
+			oops(ERR_TYPE_MISMATCH, fmt.Sprintf("type %d can't be decoded into %s",
+				t, value.Type()))
+		}
+		decode_loop(buffer, n, func(int) reflect.Value { return *value }, tail,
+			mask.root())
+
+	case n == 1 && buffer.look(1)[0] == type_structid && !wrapsIDs(value.Type()):
+		// struct with field IDs is encoded as the single field
+		decode_loop(buffer, n, func(int) reflect.Value { return *value }, tail,
+			mask.root())
+
+	default:
+		decode_loop(buffer, n, structIndex(*value, n), tail,
+			mask.structFields(*value, nil))
+	}
+
+	decodeTail(buffer, tail)
+	decodeChecksum(buffer)
+	buffer.skipIndex()
+}
+
+// decodeHeader reads the version, threshold and returns the number of fields
+func decodeHeader(buffer *decodeBuffer) uint64 {
 	head := buffer.read(2)
 	// 4 bits - version, 12 bits - threshold
-	version = uint8(head[0]) >> 4
+	version := uint8(head[0]) >> 4
 
-	if version != 1 {
+	threshold = (uint16(head[0]&0xf) << 8) | uint16(head[1])
+
+	switch version {
+	case VERSION:
+		buffer.v1 = true
+	case VERSION2:
+		flags := buffer.read(1)[0]
+		if flags&^flags_known != 0 {
+			panic("Unsupported feature flags")
+		}
+		buffer.digests = flags&flag_digest > 0
+		buffer.indexed = flags&flag_index > 0
+
+		if flags&flag_checksum > 0 {
+			buffer.checksum([]byte{head[0], head[1], flags})
+		}
+
+		if flags&flag_compressed > 0 {
+			c := lookupCompressor(buffer.read(1)[0])
+			if c == nil {
+				panic("Unsupported compression")
+			}
+			buffer.decompress(c)
+		}
+
+	default:
 		panic("Unsupported version")
 	}
 
-	threshold = (uint16(head[0]&0xf) << 8) | uint16(head[1])
+	n := decodeUNumber(buffer)
+	buffer.expect(n)
+	return n
+}
 
-	stack.n = decodeUNumber(buffer)
-	stack.index = value.Field
+// decodeTail reads the tailed data (huge strings, blobs and files) of the
+// elements after 'tail_first'
+func decodeTail(buffer *decodeBuffer, tail_first *tailElement) {
+	var tail *tailElement
+
+	// tail data processing
+	if tail_first.next != nil {
+
+		for tail = tail_first.next; tail != nil; tail = tail.next {
+			if !tail.value.IsValid() {
+				skipData(buffer, tail.length)
+				continue
+			}
+
+			switch v := tail.value.Interface().(type) {
+			case File, *File:
+				var file *File
+
+				if tail.value.Kind() == reflect.Ptr {
+					file = tail.value.Interface().(*File)
+				} else {
+					file = tail.value.Addr().Interface().(*File)
+				}
+
+				decodeFile(buffer, file)
+
+			case string, Blob:
+				val := buffer.read(tail.length)
+
+				switch v.(type) {
+				case Blob:
+					tail.value.Set(reflect.ValueOf((Blob)(val)))
+
+				case string:
+					if tail.value.Kind() == reflect.Ptr {
+						str := string(val)
+						tail.value.Set(reflect.ValueOf((*string)(&str)))
+					} else {
+						str := string(val)
+						tail.value.SetString(str)
+					}
+
+				}
+
+			case Value:
+				// string or blob of generic Value
+				val := buffer.read(tail.length)
+				data := tail.value.FieldByName("Data")
+
+				if v.Type == type_string {
+					data.Set(reflect.ValueOf(string(val)))
+				} else {
+					data.Set(reflect.ValueOf((Blob)(val)))
+				}
+
+			default:
+				panic("Wrong tail type")
+			}
+
+			// in case of valueParted we have to start at the last processed tail element
+			tail_first = tail.next
+		}
+
+	}
+}
+
+// decode_loop decodes 'n' items with its own types tree. 'index' returns the
+// destination of i'th item. huge data are appended to the 'tail' to be
+// decoded later. tail encoding is disabled if it's nil
+//
+// items with invalid destination (extra fields, mismatched types, fields out
+// of the 'mask') are parsed and dropped (see 'discard'). nil mask selects
+// all the items
+func decode_loop(buffer *decodeBuffer, n uint64, index func(int) reflect.Value,
+	tail *tailElement, mask maskFunc) {
+
+	var value_type int
+
+	var stack *stackElement = &stackElement{}
+	var tt *typesTree = &typesTree{}
+	var free *stackElement // popped elements to reuse
+
+	stack.n = n
+	stack.index = index
+	stack.mask = mask
 
 	for {
 
 		if stack.i >= stack.n {
+			if s := stack.stream; s != nil {
+				s.flush()
+
+				// next chunk of stream
+				if s.chunked {
+					if stack.n = decodeUNumber(buffer); stack.n > 0 {
+						stack.i = 0
+						stack.nullflags = buffer.read(1)
+						continue
+					}
+
+					tail = s.tail
+				}
+			}
+
+			popped := stack
 			stack = stack.parent
 			if stack == nil {
 				break
 			}
+			*popped = stackElement{parent: free}
+			free = popped
 			tt = tt.parent.next
 			continue
 		}
@@ -75,6 +247,9 @@ func decode_ext(buffer *decodeBuffer, value *reflect.Value) {
 			// have to skip if the NULL flag is set
 			if flags&(1<<(7-(uint(stack.i)%8))) > 0 {
 				// NULL value. skip it
+				if stack.stream != nil {
+					stack.stream.null()
+				}
 				if tt.next == nil {
 					tt = tt.append(tt.ttype)
 				} else {
@@ -91,38 +266,84 @@ func decode_ext(buffer *decodeBuffer, value *reflect.Value) {
 			value_type = tt.ttype
 		}
 
-		field := stack.index(int(stack.i))
+		var field reflect.Value
+		var fmask *fieldMask
+		var selected bool = true
+
+		if stack.mask != nil {
+			fmask, selected = stack.mask(int(stack.i))
+		}
+
+		if selected {
+			field = stack.index(int(stack.i))
+		}
+
+		if field.IsValid() && !compatible(field.Type(), value_type) {
+			if strict {
+				oops(ERR_TYPE_MISMATCH, fmt.Sprintf("type %d can't be decoded into %s",
+					value_type, field.Type()))
+			}
+			field = reflect.Value{}
+		}
+
+		// generic value. decode the data into the variable of natural type
+		// and put it to the Value
+		var vfield reflect.Value
+		if field.IsValid() && field.Type() == valueType {
+			vfield = field
+			field = valueField(vfield, value_type)
+		}
 
 		switch value_type {
 
 		// STRUCT
-		case type_struct:
+		case type_struct, type_structid:
 			var n uint64
 			var nullflags []byte
 
 			if tt.ttype == type_undefined {
 				n = decodeUNumber(buffer)
 				tt.n = n
-				nullflags = []byte{0}
+				tt.ids = decodeIDs(buffer, value_type, n)
+				nullflags = nil
 			} else {
 				if tt.n == 0 {
 					n = decodeUNumber(buffer)
 					nullflags = nil
 					tt.n = n
+					tt.ids = decodeIDs(buffer, value_type, n)
 				} else {
 					n = tt.n
 					nullflags = buffer.read(1)
 				}
 			}
 
-			if field.Kind() == reflect.Ptr {
-				pstruct := reflect.New(field.Type().Elem())
-				field.Set(pstruct)
-				field = pstruct.Elem()
+			index := discard
+			var mask maskFunc
+
+			if field.IsValid() {
+				if field.Kind() == reflect.Ptr {
+					pstruct := reflect.New(field.Type().Elem())
+					field.Set(pstruct)
+					field = pstruct.Elem()
+				}
+
+				if field.Kind() == reflect.Slice {
+					// fields of generic Value
+					buffer.expect(n)
+					mask = fmask.valueItems(tt.ids)
+					index = makeItems(field, n, mask)
+				} else if value_type == type_structid {
+					index = idIndex(field, tt.ids)
+					mask = fmask.structFields(field, tt.ids)
+				} else {
+					index = structIndex(field, n)
+					mask = fmask.structFields(field, nil)
+				}
 			}
 
 			stack.i += 1
-			stack = &stackElement{stack, 0, n, field, field.Field, nullflags}
+			stack = pushStack(&free, stackElement{stack, 0, n, field, index, nullflags, mask, nil})
 
 			if tt.child == nil {
 				tt = tt.addchild(value_type)
@@ -132,11 +353,35 @@ func decode_ext(buffer *decodeBuffer, value *reflect.Value) {
 
 			continue
 
-		case type_struct_null:
+		// STREAM
+		case type_stream:
+			var s *streamLevel
+			if fmask != nil && fmask.sink != nil && field.IsValid() {
+				s = fmask.sink.attach(&tail, true)
+			} else {
+				s = newStreamLevel(field, tail)
+			}
+
+			// chunks are read at the top of loop. tail encoding is disabled
+			// for the elements
+			stack.i += 1
+			stack = pushStack(&free, stackElement{stack, 0, 0, field, s.item, nil, nil, s})
+			tail = nil
+
+			if tt.child == nil {
+				tt = tt.addchild(value_type)
+				tt.next = tt
+			} else {
+				tt = tt.child
+			}
+
+			continue
+
+		case type_struct_null, type_structid_null:
+			value_type = 255 - value_type
 			if tt.child == nil {
-				tt.addchild(type_struct)
+				tt.addchild(value_type)
 			}
-			value_type = type_struct
 
 		// ARRAY, ARRAYN
 		case type_array, type_arrayn:
@@ -149,18 +394,42 @@ func decode_ext(buffer *decodeBuffer, value *reflect.Value) {
 				nullflags = buffer.read(1)
 			}
 
-			if field.Kind() == reflect.Ptr {
-				parray := reflect.New(field.Type().Elem())
-				field.Set(parray)
-				field = parray.Elem()
-			}
+			index := discard
+			var mask maskFunc
+			var stream *streamLevel
+
+			if fmask != nil && fmask.sink != nil && field.IsValid() {
+				// items are passed to the sink one by one
+				stream = fmask.sink.attach(&tail, false)
+				index = stream.item
+			} else if field.IsValid() {
+				if field.Kind() == reflect.Ptr {
+					parray := reflect.New(field.Type().Elem())
+					field.Set(parray)
+					field = parray.Elem()
+				}
 
-			if field.Kind() == reflect.Slice {
-				field.Set(reflect.MakeSlice(field.Type(), int(n), int(n)))
+				if field.Kind() == reflect.Slice {
+					buffer.expect(n)
+				}
+
+				switch {
+				case field.Type() == itemsType:
+					// items of generic Value
+					mask = fmask.valueItems(nil)
+					index = makeItems(field, n, mask)
+				case field.Kind() == reflect.Slice:
+					field.Set(reflect.MakeSlice(field.Type(), int(n), int(n)))
+					index = field.Index
+					mask = fmask.arrayItems()
+				default:
+					index = arrayIndex(field, n)
+					mask = fmask.arrayItems()
+				}
 			}
 
 			stack.i += 1
-			stack = &stackElement{stack, 0, n, field, field.Index, nullflags}
+			stack = pushStack(&free, stackElement{stack, 0, n, field, index, nullflags, mask, stream})
 
 			if tt.child == nil {
 				tt = tt.addchild(value_type)
@@ -190,50 +459,53 @@ func decode_ext(buffer *decodeBuffer, value *reflect.Value) {
 		case type_number:
 			num := decodeNumber(buffer)
 
-			if field.Kind() == reflect.Ptr {
+			switch {
+			case !field.IsValid():
+			case field.Kind() == reflect.Ptr:
 				ifield := reflect.New(field.Type().Elem())
 				ifield.Elem().SetInt(num)
 				field.Set(ifield)
-			} else {
+			default:
 				field.SetInt(num)
 			}
 
 		case type_number_null:
-			ifield := reflect.NewAt(field.Type().Elem(), nil)
-			field.Set(ifield)
+			setNull(field)
 			value_type = type_number
 
 		// UNUMBER
 		case type_unumber:
 			num := decodeUNumber(buffer)
 
-			if field.Kind() == reflect.Ptr {
+			switch {
+			case !field.IsValid():
+			case field.Kind() == reflect.Ptr:
 				ifield := reflect.New(field.Type().Elem())
 				ifield.Elem().SetUint(num)
 				field.Set(ifield)
-			} else {
+			default:
 				field.SetUint(num)
 			}
 
 		case type_unumber_null:
-			ifield := reflect.NewAt(field.Type().Elem(), nil)
-			field.Set(ifield)
+			setNull(field)
 			value_type = type_unumber
 
 		// FLOAT
 		case type_float:
-			f := decodeFloat(buffer)
-
-			if field.Kind() == reflect.Ptr {
+			switch {
+			case !field.IsValid():
+				skipFloat(buffer)
+			case field.Kind() == reflect.Ptr:
 				ifield := reflect.New(field.Type().Elem())
-				ifield.Elem().SetFloat(f)
-				field.Set(reflect.ValueOf((*float64)(&f)))
-			} else {
-				field.SetFloat(f)
+				ifield.Elem().SetFloat(decodeFloat(buffer, ifield.Elem().Type().Bits()))
+				field.Set(ifield)
+			default:
+				field.SetFloat(decodeFloat(buffer, field.Type().Bits()))
 			}
+
 		case type_float_null:
-			ifield := reflect.NewAt(field.Type().Elem(), nil)
-			field.Set(ifield)
+			setNull(field)
 			value_type = type_float
 
 		// BOOL
@@ -244,81 +516,172 @@ func decode_ext(buffer *decodeBuffer, value *reflect.Value) {
 				b = true
 			}
 
-			if field.Kind() == reflect.Ptr {
-				field.Set(reflect.ValueOf((*bool)(&b)))
-			} else {
+			switch {
+			case !field.IsValid():
+			case field.Kind() == reflect.Ptr:
+				ifield := reflect.New(field.Type().Elem())
+				ifield.Elem().SetBool(b)
+				field.Set(ifield)
+			default:
 				field.SetBool(b)
 			}
 
 		case type_bool_null:
-			ifield := reflect.NewAt(field.Type().Elem(), nil)
-			field.Set(ifield)
+			setNull(field)
 			value_type = type_bool
 
 		// STRING
 		case type_string:
 			string_len := decodeUNumber(buffer)
 
-			if (threshold > 0) && (string_len > uint64(threshold)) && (tail != nil) {
+			switch {
+			case (threshold > 0) && (string_len > uint64(threshold)) && (tail != nil):
 				// len of value > threshold. push it to the tail
-				tail = tail.append(field, string_len)
+				tail = tail.append(tailValue(field, vfield), string_len)
 
-			} else {
+			case !field.IsValid():
+				buffer.read(string_len)
 
+			default:
 				s := string(buffer.read(string_len))
 
 				if field.Kind() == reflect.Ptr {
-					field.Set(reflect.ValueOf((*string)(&s)))
+					ifield := reflect.New(field.Type().Elem())
+					ifield.Elem().SetString(s)
+					field.Set(ifield)
 				} else {
 					field.SetString(s)
 				}
 			}
 
 		case type_string_null:
-			field.Set(reflect.ValueOf((*string)(nil)))
+			setNull(field)
 			value_type = type_string
 
 		// DATE
 		case type_date:
-			dt := decodeDate(buffer)
-
-			if field.Kind() == reflect.Ptr {
-				field.Set(reflect.ValueOf((*time.Time)(dt)))
-			} else {
-				field.Set(reflect.ValueOf((time.Time)(*dt)))
+			if !field.IsValid() {
+				buffer.read(8)
+				break
 			}
 
+			dt := decodeDate(buffer)
+			setDate(field, dt)
+
 		case type_date_null:
-			field.Set(reflect.ValueOf((*time.Time)(nil)))
+			setNull(field)
 			value_type = type_date
 
+		case type_ndate:
+			if !field.IsValid() {
+				skipDateNano(buffer)
+				break
+			}
+
+			dt := decodeDateNano(buffer)
+			setDate(field, dt)
+
+		case type_ndate_null:
+			setNull(field)
+			value_type = type_ndate
+
+		// BIG NUMBER
+		case type_bignumber:
+			if !field.IsValid() {
+				skipBigNumber(buffer)
+				break
+			}
+
+			x := decodeBigNumber(buffer)
+
+			switch {
+			case field.Kind() == reflect.Ptr:
+				field.Set(reflect.ValueOf(x))
+			default:
+				field.Set(reflect.ValueOf(*x))
+			}
+
+		case type_bignumber_null:
+			setNull(field)
+			value_type = type_bignumber
+
+		// BIG FLOAT
+		case type_bigfloat:
+			if !field.IsValid() {
+				skipBigFloat(buffer)
+				break
+			}
+
+			x := decodeBigFloat(buffer)
+
+			switch {
+			case field.Kind() == reflect.Ptr:
+				field.Set(reflect.ValueOf(x))
+			default:
+				field.Set(reflect.ValueOf(*x))
+			}
+
+		case type_bigfloat_null:
+			setNull(field)
+			value_type = type_bigfloat
+
+		// EXTENSION
+		case type_ext:
+			if tt.ttype == type_undefined {
+				tt.n = decodeUNumber(buffer)
+			}
+
+			decodeExt(buffer, tt.n, field)
+
+		case type_ext_null:
+			tt.n = decodeUNumber(buffer)
+			setNull(field)
+			value_type = type_ext
+
 		// BLOB
 		case type_blob:
 			blob_len := decodeUNumber(buffer)
 
-			if (threshold > 0) && (blob_len > uint64(threshold)) && (tail != nil) {
+			switch {
+			case (threshold > 0) && (blob_len > uint64(threshold)) && (tail != nil):
 				// len of value > threshold. push it to the tail
-				tail = tail.append(field, blob_len)
+				tail = tail.append(tailValue(field, vfield), blob_len)
 
-			} else {
+			case !field.IsValid():
+				buffer.read(blob_len)
+
+			default:
 				field.Set(reflect.ValueOf((Blob)(buffer.read(blob_len))))
 			}
 
 		case type_blob_null:
-			field.Set(reflect.ValueOf((Blob)(nil)))
+			setNull(field)
 			value_type = type_blob
 
 		// FILE
 		case type_file:
 			var file *File
-			var filevalue reflect.Value
 			var file_len, filename_len uint64
 
+			file_len = decodeUNumber(buffer)
+			filename_len = decodeUNumber(buffer)
+			tailed := (threshold > 0) && (file_len > uint64(threshold)) && (tail != nil)
+
+			if !field.IsValid() {
+				buffer.read(filename_len)
+
+				if tailed {
+					tail = tail.append(field, file_len+buffer.digestSize())
+				} else {
+					skipData(buffer, file_len+buffer.digestSize())
+				}
+				break
+			}
+
 			if field.Kind() == reflect.Ptr {
 				if field.IsNil() {
-					file = new(File)
-					filevalue = reflect.ValueOf(&file)
-					field.Set(filevalue)
+					file = &File{}
+					field.Set(reflect.ValueOf(file))
 				} else {
 					file = field.Interface().(*File)
 				}
@@ -327,12 +690,10 @@ func decode_ext(buffer *decodeBuffer, value *reflect.Value) {
 				file = field.Addr().Interface().(*File)
 			}
 
-			file_len = decodeUNumber(buffer)
-			filename_len = decodeUNumber(buffer)
 			file.Name = string(buffer.read(filename_len))
 			file.length = file_len
 
-			if (threshold > 0) && (file_len > uint64(threshold)) && (tail != nil) {
+			if tailed {
 				// len of value > threshold. push it to the tail
 				tail = tail.append(field, file_len)
 			} else {
@@ -340,13 +701,25 @@ func decode_ext(buffer *decodeBuffer, value *reflect.Value) {
 			}
 
 		case type_file_null:
-			field.Set(reflect.ValueOf((*File)(nil)))
+			setNull(field)
 			value_type = type_file
 
+		// INTERFACE
+		case type_interface:
+			decodeInterface(buffer, field)
+
+		case type_interface_null:
+			setNull(field)
+			value_type = type_interface
+
 		default:
 			panic("FIXME. bug!")
 		}
 
+		if vfield.IsValid() {
+			setValueData(vfield, field)
+		}
+
 		stack.i += 1
 		if tt.next == nil {
 			tt = tt.append(value_type)
@@ -357,51 +730,6 @@ func decode_ext(buffer *decodeBuffer, value *reflect.Value) {
 			tt = tt.next
 		}
 	} // end of main loop
-
-	// tail data processing
-	if tail_first.next != nil {
-
-		for tail = tail_first.next; tail != nil; tail = tail.next {
-			switch v := tail.value.Interface().(type) {
-			case File, *File:
-				var file *File
-
-				if tail.value.Kind() == reflect.Ptr {
-					file = tail.value.Interface().(*File)
-				} else {
-					file = tail.value.Addr().Interface().(*File)
-				}
-
-				decodeFile(buffer, file)
-
-			case string, Blob:
-				val := buffer.read(tail.length)
-
-				switch v.(type) {
-				case Blob:
-					tail.value.Set(reflect.ValueOf((Blob)(val)))
-
-				case string:
-					if tail.value.Kind() == reflect.Ptr {
-						str := string(val)
-						tail.value.Set(reflect.ValueOf((*string)(&str)))
-					} else {
-						str := string(val)
-						tail.value.SetString(str)
-					}
-
-				}
-
-			default:
-				panic("Wrong tail type")
-			}
-
-			// in case of valueParted we have to start at the last processed tail element
-			tail_first = tail.next
-		}
-
-	}
-
 }
 
 func DecodeNumber(buffer []byte) int64 {
@@ -507,7 +835,8 @@ func decodeNumber(buffer *decodeBuffer) int64 {
 	bb := buffer.read(uint64(l - 1))
 
 	if l < 8 {
-		val = unpack_number(append([]byte{b}, bb...), l)
+		// leading bits of the first byte
+		val = uint64(b)<<((l-1)*8) | unpack_number(bb, l-1)
 	} else {
 		val = unpack_number(bb, l-1)
 	}
@@ -561,7 +890,8 @@ func decodeUNumber(buffer *decodeBuffer) uint64 {
 	bb := buffer.read(uint64(l - 1))
 
 	if l < 8 {
-		value = unpack_number(append([]byte{b}, bb...), l)
+		// leading bits of the first byte
+		value = uint64(b)<<((l-1)*8) | unpack_number(bb, l-1)
 	} else {
 		value = unpack_number(bb, l-1)
 	}
@@ -573,18 +903,118 @@ func DecodeFloat(buffer []byte) float64 {
 	var b decodeBuffer
 
 	b.init_buffer(buffer)
-	return decodeFloat(&b)
+	return decodeFloat(&b, 64)
 }
 
-func decodeFloat(buffer *decodeBuffer) float64 {
-	var float_value float64
-	var powerbyte []byte
+func DecodeFloat32(buffer []byte) float32 {
+	var b decodeBuffer
+
+	b.init_buffer(buffer)
+	return float32(decodeFloat(&b, 32))
+}
+
+// decodeFloat returns the value correctly rounded to the float of 'bits' size
+func decodeFloat(buffer *decodeBuffer, bits int) float64 {
+	var scale int
+
+	switch b := buffer.read(1)[0]; {
+	case buffer.v1:
+		// unsigned scale with no reserved values. see encodeFloatV1
+		scale = int(b)
+	case b == float_nan:
+		return math.NaN()
+	case b == float_inf:
+		return math.Inf(1)
+	case b == float_ninf:
+		return math.Inf(-1)
+	case b == float_nzero:
+		return math.Copysign(0, -1)
+	case b == float_scale_ext:
+		scale = int(decodeNumber(buffer))
+	default:
+		scale = int(int8(b))
+	}
+
+	significand := decodeNumber(buffer)
+
+	// fast path. both of operands are exact, so the result of single
+	// multiplication (division) is correctly rounded
+	if bits == 64 && significand < 1<<53 && significand > -(1<<53) {
+		switch {
+		case scale == 0:
+			return float64(significand)
+		case scale > 0 && scale < len(float_pow10):
+			return float64(significand) / float_pow10[scale]
+		case scale < 0 && -scale < len(float_pow10):
+			return float64(significand) * float_pow10[-scale]
+		}
+	}
+
+	// out of range values are rounded to 0 or Inf by ParseFloat. ignore
+	// the error in this case
+	f, _ := strconv.ParseFloat(strconv.FormatInt(significand, 10)+"e"+strconv.Itoa(-scale), bits)
+	return f
+}
 
-	powerbyte = buffer.read(1)
-	int_value := decodeNumber(buffer)
+// exact powers of 10 in float64
+var float_pow10 = []float64{1e0, 1e1, 1e2, 1e3, 1e4, 1e5, 1e6, 1e7, 1e8, 1e9,
+	1e10, 1e11, 1e12, 1e13, 1e14, 1e15, 1e16, 1e17, 1e18, 1e19, 1e20, 1e21, 1e22}
 
-	float_value = float64(int_value) / math.Pow(10, float64(powerbyte[0]))
-	return float_value
+// big number. see EncodeBigNumber
+func DecodeBigNumber(buffer []byte) *big.Int {
+	var b decodeBuffer
+
+	b.init_buffer(buffer)
+	return decodeBigNumber(&b)
+}
+
+func decodeBigNumber(buffer *decodeBuffer) *big.Int {
+	var x big.Int
+
+	length := decodeNumber(buffer)
+
+	if length < 0 {
+		x.SetBytes(buffer.read(uint64(-length)))
+		return x.Neg(&x)
+	}
+
+	return x.SetBytes(buffer.read(uint64(length)))
+}
+
+// big float. see EncodeBigFloat
+func DecodeBigFloat(buffer []byte) *big.Float {
+	var b decodeBuffer
+
+	b.init_buffer(buffer)
+	return decodeBigFloat(&b)
+}
+
+func decodeBigFloat(buffer *decodeBuffer) *big.Float {
+	var x big.Float
+
+	prec := uint(decodeUNumber(buffer))
+	flags := buffer.read(1)[0]
+	neg := flags&(1<<3) > 0
+
+	x.SetMode(big.RoundingMode(flags & 0x7)).SetPrec(prec)
+
+	switch flags >> 4 {
+	case bigfloat_inf:
+		return x.SetInf(neg)
+
+	case bigfloat_zero:
+		if neg {
+			x.Neg(&x)
+		}
+		return &x
+	}
+
+	mantissa := decodeBigNumber(buffer)
+	exp := decodeNumber(buffer)
+
+	// the mantissa fits the precision, so it is set exactly
+	x.SetInt(mantissa)
+	return x.SetMantExp(&x, int(exp))
 }
 
 // 2B:   year. (-32767..32768)
@@ -617,46 +1047,356 @@ func decodeDate(buffer *decodeBuffer) *time.Time {
 
 	datebin := buffer.read(8)
 
-	year = int(uint(datebin[0])<<8 | uint(datebin[1]))
+	year = int(int16(uint16(datebin[0])<<8 | uint16(datebin[1])))
 	month = time.Month(uint(datebin[2]) >> 4)
 	day = int(((uint(datebin[2]) & 0xf) << 1) | (uint(datebin[3]) >> 7))
 	hour = int((uint(datebin[3]) & 0x7f) >> 2)
 	min = int(((uint(datebin[3]) & 0x3) << 4) | (uint(datebin[4]) >> 4))
 	sec = int(((uint(datebin[4]) & 0xf) << 2) | (uint(datebin[5]) >> 6))
 	nsec = int(((uint(datebin[5])&0x3f)<<4)|(uint(datebin[6])>>4)) * 1000000
-	offh = int(((uint(datebin[6]) & 0xf) << 2) | (uint(datebin[7]) >> 6))
+	// hours offset is a signed 6 bits value. shift it to the high bits of
+	// int8 and back to extend the sign
+	offh = int(int8((datebin[6]&0xf)<<4|(datebin[7]>>6)<<2) >> 2)
 	offm = int(uint(datebin[7]) & 0x3f)
 
+	if offh < 0 {
+		offm *= -1
+	}
+
 	loc = time.FixedZone(" ", offh*3600+offm*60)
 	date = time.Date(year, month, day, hour, min, sec, nsec, loc)
 
 	return &date
 }
 
+// lossless date. see EncodeDateNano
+func DecodeDateNano(buffer []byte) *time.Time {
+	var b decodeBuffer
+
+	b.init_buffer(buffer)
+	return decodeDateNano(&b)
+}
+
+func decodeDateNano(buffer *decodeBuffer) *time.Time {
+	var date time.Time
+	var loc *time.Location
+
+	sec := decodeNumber(buffer)
+	nsec := int64(decodeUNumber(buffer))
+	offset := int(decodeNumber(buffer))
+	name := string(buffer.read(decodeUNumber(buffer)))
+
+	date = time.Unix(sec, nsec)
+
+	// use the named location if it is known here and gives the same offset
+	// at this moment. otherwise keep the offset only
+	if name != "" {
+		if l, err := loadLocation(name); err == nil {
+			if _, o := date.In(l).Zone(); o == offset {
+				loc = l
+			}
+		}
+	}
+
+	if loc == nil {
+		loc = time.FixedZone(name, offset)
+	}
+
+	date = date.In(loc)
+	return &date
+}
+
+var locations sync.Map
+
+func loadLocation(name string) (*time.Location, error) {
+	if l, ok := locations.Load(name); ok {
+		return l.(*time.Location), nil
+	}
+
+	l, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+
+	locations.Store(name, l)
+	return l, nil
+}
+
 func decodeFile(buffer *decodeBuffer, file *File) {
 	var bin []byte
+	var w io.Writer
 
 	file.f, _ = ioutil.TempFile(dir, "llsndecode_")
 	file.tmp = file.f.Name()
 
-	defer file.f.Close()
+	defer func() {
+		file.f.Close()
+
+		// the broken file (e.g. digest mismatch) is not left on the disk
+		if r := recover(); r != nil {
+			os.Remove(file.tmp)
+			file.tmp = ""
+			panic(r)
+		}
+	}()
 	n := uint64(65535) // 64K
 
+	w = file.f
+	h := sha256.New()
+	if buffer.digests {
+		w = io.MultiWriter(file.f, h)
+	}
+
 	for {
 		if n < file.length {
 			bin = buffer.read(n)
-			file.f.Write(bin)
+			w.Write(bin)
 			file.length -= n
 		} else {
 			bin = buffer.read(file.length)
-			file.f.Write(bin)
+			w.Write(bin)
 			break
 		}
 	}
+
+	if buffer.digests {
+		verifyDigest(buffer, h.Sum(nil), file.Name)
+	}
 }
 
 // Decode helpers //////////////////////////////////////////////////////////////
 
+// skip* helpers advance past the value with no allocation
+
+func skipFloat(buffer *decodeBuffer) {
+	switch b := buffer.read(1)[0]; {
+	case buffer.v1:
+	case b == float_nan, b == float_inf, b == float_ninf, b == float_nzero:
+		return
+	case b == float_scale_ext:
+		decodeNumber(buffer)
+	}
+
+	decodeNumber(buffer)
+}
+
+func skipDateNano(buffer *decodeBuffer) {
+	decodeNumber(buffer)
+	decodeUNumber(buffer)
+	decodeNumber(buffer)
+	buffer.read(decodeUNumber(buffer))
+}
+
+func skipBigNumber(buffer *decodeBuffer) {
+	length := decodeNumber(buffer)
+
+	if length < 0 {
+		length = -length
+	}
+	buffer.read(uint64(length))
+}
+
+func skipBigFloat(buffer *decodeBuffer) {
+	decodeUNumber(buffer)
+
+	if buffer.read(1)[0]>>4 == bigfloat_finite {
+		skipBigNumber(buffer)
+		decodeNumber(buffer)
+	}
+}
+
+// discard is the index function for the items to be parsed and dropped
+func discard(int) reflect.Value {
+	return reflect.Value{}
+}
+
+// makeItems allocates the Items of generic Value for 'n' encoded items. with
+// the mask only the selected items are kept, in order of encoding
+func makeItems(v reflect.Value, n uint64, mask maskFunc) func(int) reflect.Value {
+	if mask == nil {
+		v.Set(reflect.MakeSlice(v.Type(), int(n), int(n)))
+		return v.Index
+	}
+
+	slots := make(map[int]int)
+	for i := 0; i < int(n); i++ {
+		if _, ok := mask(i); ok {
+			slots[i] = len(slots)
+		}
+	}
+
+	v.Set(reflect.MakeSlice(v.Type(), len(slots), len(slots)))
+
+	return func(i int) reflect.Value {
+		return v.Index(slots[i])
+	}
+}
+
+// tailValue returns the destination of tailed data. it's the Value itself
+// for the generic Value, the data are set to it later
+func tailValue(field, vfield reflect.Value) reflect.Value {
+	if vfield.IsValid() {
+		return vfield
+	}
+	return field
+}
+
+// decodeIDs reads 'n' field IDs of the struct with field IDs
+func decodeIDs(buffer *decodeBuffer, value_type int, n uint64) []uint64 {
+	if value_type != type_structid {
+		return nil
+	}
+
+	buffer.expect(n)
+
+	ids := make([]uint64, n)
+	for i := range ids {
+		ids[i] = decodeUNumber(buffer)
+	}
+	return ids
+}
+
+// wrapsIDs returns true if the single field of struct type 't' is the struct
+// with field IDs. the packet of such struct is the same as the packet of the
+// top level struct with field IDs
+func wrapsIDs(t reflect.Type) bool {
+	si := getStructInfo(t)
+	if len(si.fields) != 1 || si.ids != nil {
+		return false
+	}
+
+	f := si.fields[0].t
+	if f.Kind() == reflect.Ptr {
+		f = f.Elem()
+	}
+	return hasIDs(f)
+}
+
+// arrayIndex returns the index function for the fixed size array with 'n'
+// encoded items
+func arrayIndex(v reflect.Value, n uint64) func(int) reflect.Value {
+	l := v.Len()
+
+	if strict && uint64(l) != n {
+		oops(ERR_FIELDS_MISMATCH, fmt.Sprintf("%s has %d items, received %d",
+			v.Type(), l, n))
+	}
+
+	if uint64(l) >= n {
+		return v.Index
+	}
+
+	return func(i int) reflect.Value {
+		if i < l {
+			return v.Index(i)
+		}
+		return reflect.Value{}
+	}
+}
+
+// compatible returns true if the value of 'value_type' can be decoded into
+// the destination of type 't'
+func compatible(t reflect.Type, value_type int) bool {
+	if t == valueType {
+		return true
+	}
+
+	// null types are "reversed" (type_number_null = 255 - type_number)
+	if value_type > type_last {
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Interface:
+		default:
+			return false
+		}
+		value_type = 255 - value_type
+	}
+
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch value_type {
+	case type_number:
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return true
+		}
+	case type_unumber:
+		switch t.Kind() {
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return true
+		}
+	case type_float:
+		return t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64
+	case type_bool:
+		return t.Kind() == reflect.Bool
+	case type_string:
+		return t.Kind() == reflect.String
+	case type_blob:
+		return blobType.AssignableTo(t)
+	case type_date, type_ndate:
+		return t == dateType
+	case type_file:
+		return t == fileType
+	case type_bignumber:
+		return t == bignumberType
+	case type_bigfloat:
+		return t == bigfloatType
+	case type_struct, type_structid:
+		return t.Kind() == reflect.Struct && t != dateType && t != fileType &&
+			t != bignumberType && t != bigfloatType
+	case type_array, type_arrayn:
+		return t.Kind() == reflect.Array || t.Kind() == reflect.Slice
+	case type_stream:
+		return t.Kind() == reflect.Slice || t.Implements(streamerType)
+	case type_ext:
+		// depends on the extension ID. see decodeExt
+		return true
+	case type_interface:
+		return t.Kind() == reflect.Interface
+	}
+
+	return false
+}
+
+var blobType = reflect.TypeOf(Blob{})
+var dateType = reflect.TypeOf(time.Time{})
+var fileType = reflect.TypeOf(File{})
+var bignumberType = reflect.TypeOf(big.Int{})
+var bigfloatType = reflect.TypeOf(big.Float{})
+
+func setNull(field reflect.Value) {
+	if field.IsValid() {
+		field.Set(reflect.Zero(field.Type()))
+	}
+}
+
+func setDate(field reflect.Value, dt *time.Time) {
+	switch {
+	case !field.IsValid():
+	case field.Kind() == reflect.Ptr:
+		field.Set(reflect.ValueOf((*time.Time)(dt)))
+	default:
+		field.Set(reflect.ValueOf((time.Time)(*dt)))
+	}
+}
+
+// skipData drops 'n' bytes of the data
+func skipData(buffer *decodeBuffer, n uint64) {
+	chunk := uint64(read_chunk)
+
+	if buffer.skip != nil {
+		buffer.skip(n)
+		return
+	}
+
+	for n > chunk {
+		buffer.read(chunk)
+		n -= chunk
+	}
+	buffer.read(n)
+}
+
 func unpack_number(buffer []byte, n uint8) uint64 {
 	var v uint64
 
@@ -666,11 +1406,39 @@ func unpack_number(buffer []byte, n uint8) uint64 {
 	return v
 }
 
+// the data longer than read_chunk are read by chunks
+const read_chunk = 65535 // 64K
+
 type decodeBuffer struct {
 	buffer  []byte
 	channel chan []byte
+	reader  *bufio.Reader
+	at      io.ReaderAt
+	offset  int64 // offset of the reader 'at'
 	read    func(uint64) []byte
 	look    func(uint64) []byte
+	skip    func(uint64) // optional. see skipData
+
+	raw     *bufio.Reader // compressed source. see decompress
+	crc     hash.Hash32   // checksum of the data read. see checksum
+	digests bool          // file data are followed by the digest
+	indexed bool          // the index trailer follows the packet
+	v1      bool          // the header of version 1. see decodeFloat
+}
+
+func (b *decodeBuffer) init_source(source interface{}) error {
+	switch v := source.(type) {
+	case []byte:
+		b.init_buffer(v)
+
+	case chan []byte:
+		b.init_chan(v)
+
+	default:
+		return errors.New("Incorrect type of the source (expect 'chan []byte' or '[]byte'")
+	}
+
+	return nil
 }
 
 func (b *decodeBuffer) init_chan(channel chan []byte) {
@@ -685,6 +1453,69 @@ func (b *decodeBuffer) init_buffer(buffer []byte) {
 	b.look = b.look_buffer
 }
 
+// init_reader_at reads the source 'r' from the 'offset'
+func (b *decodeBuffer) init_reader_at(r io.ReaderAt, offset int64) {
+	b.at = r
+	b.offset = offset
+	b.reader = bufio.NewReader(io.NewSectionReader(r, offset, math.MaxInt64-offset))
+	b.read = b.read_reader
+	b.look = b.look_reader
+	b.skip = b.skip_reader
+}
+
+func (b *decodeBuffer) read_reader(n uint64) []byte {
+	if n > read_chunk {
+		// the malformed length can't make the huge allocation. the buffer
+		// grows as the data are read
+		var buff bytes.Buffer
+		if _, err := io.CopyN(&buff, b.reader, int64(min(n, math.MaxInt64))); err != nil {
+			panic(err)
+		}
+
+		b.offset += int64(n)
+		return buff.Bytes()
+	}
+
+	buff := make([]byte, n)
+
+	if _, err := io.ReadFull(b.reader, buff); err != nil {
+		panic(err)
+	}
+
+	b.offset += int64(n)
+	return buff
+}
+
+func (b *decodeBuffer) look_reader(n uint64) []byte {
+	for n > uint64(b.reader.Size()) {
+		// it's longer than the buffer of reader. wrap the reader into the
+		// bigger one when the data are buffered
+		if _, err := b.reader.Peek(b.reader.Size()); err != nil {
+			panic(err)
+		}
+		b.reader = bufio.NewReaderSize(b.reader, int(min(n, uint64(2*b.reader.Size()))))
+	}
+
+	buff, err := b.reader.Peek(int(n))
+	if err != nil {
+		panic(err)
+	}
+
+	return buff
+}
+
+// skip_reader seeks over the data which are not buffered yet
+func (b *decodeBuffer) skip_reader(n uint64) {
+	if n <= uint64(b.reader.Buffered()) {
+		b.reader.Discard(int(n))
+		b.offset += int64(n)
+		return
+	}
+
+	b.offset += int64(n)
+	b.reader.Reset(io.NewSectionReader(b.at, b.offset, math.MaxInt64-b.offset))
+}
+
 func (b *decodeBuffer) waitdata() {
 	select {
 	case buffer, ok := <-b.channel:
@@ -699,10 +1530,32 @@ func (b *decodeBuffer) waitdata() {
 	}
 }
 
+// skipIndex reads the index trailer of packet from the channel source (see
+// index.go), so the encoder sending it doesn't block
+func (b *decodeBuffer) skipIndex() {
+	if !b.indexed || b.channel == nil {
+		return
+	}
+
+	// offsets and first tail elements of the fields, offsets of the tail
+	// elements
+	n := 2 * decodeUNumber(b)
+	for i := uint64(0); i < n; i++ {
+		decodeUNumber(b)
+	}
+	n = decodeUNumber(b)
+	for i := uint64(0); i < n; i++ {
+		decodeUNumber(b)
+	}
+
+	// offset of index and magic
+	b.read(8 + uint64(len(index_magic)))
+}
+
 func (b *decodeBuffer) read_chan(n uint64) []byte {
 
 	for {
-		if len(b.buffer) >= int(n) {
+		if uint64(len(b.buffer)) >= n {
 			return b.read_buffer(n)
 		}
 
@@ -713,7 +1566,7 @@ func (b *decodeBuffer) read_chan(n uint64) []byte {
 func (b *decodeBuffer) look_chan(n uint64) []byte {
 
 	for {
-		if len(b.buffer) >= int(n) {
+		if uint64(len(b.buffer)) >= n {
 			return b.look_buffer(n)
 		}
 
@@ -730,3 +1583,19 @@ func (b *decodeBuffer) read_buffer(n uint64) []byte {
 func (b *decodeBuffer) look_buffer(n uint64) []byte {
 	return b.buffer[:n]
 }
+
+// expect panics if the rest of data is too short for 'n' items (fields,
+// array items, IDs). it's called before the items are allocated, so the
+// malformed number can't exhaust the memory. every item takes 1 bit at
+// least (null flag), the first byte of null flags is read already
+func (b *decodeBuffer) expect(n uint64) {
+	if n < 16 {
+		return
+	}
+
+	// the channel source waits for the chunks until n/8 bytes are buffered
+	// (or the channel is closed). the items are read from there next, so it
+	// doesn't wait longer than decoding does, and it buffers no more than
+	// the peer has sent
+	b.look(n/8 - 1)
+}
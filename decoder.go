@@ -0,0 +1,110 @@
+// Golang support for LLSN - Allyst's data interchange format.
+// LLSN specification http://allyst.org/opensource/llsn/
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// copyright (C) 2015 Allyst Inc. http://allyst.com
+// author Taras Halturin <halturin@allyst.com>
+
+package llsn
+
+import (
+	"errors"
+	"io"
+	"reflect"
+)
+
+// Decoder reads the fields of packet one by one. Every field can be decoded
+// into the variable of its own or skipped with all of its subtree. Tailed data
+// (huge strings, blobs and files) are read with the last field, so they are
+// available when More returns false.
+type Decoder struct {
+	buffer     decodeBuffer
+	threshold  uint16
+	n, i       uint64
+	tail       *tailElement
+	tail_first *tailElement
+}
+
+// NewDecoder reads the header of packet. The source is '[]byte' or
+// 'chan []byte'
+func NewDecoder(source interface{}) (d *Decoder, err error) {
+	defer recoverError(&err)
+
+	d = &Decoder{}
+	if err := d.buffer.init_source(source); err != nil {
+		return nil, err
+	}
+
+	d.n = decodeHeader(&d.buffer)
+	d.threshold = threshold
+	d.tail = &tailElement{}
+	d.tail_first = d.tail
+
+	return d, nil
+}
+
+// More returns true if there are fields to read
+func (d *Decoder) More() bool {
+	return d.i < d.n
+}
+
+// Skip advances past the next field. The values are not allocated, only the
+// types of field are kept, so the allocations don't depend on the amount of
+// data. Files are not written to the disk
+func (d *Decoder) Skip() error {
+	return d.next(reflect.Value{})
+}
+
+// Decode reads the next field into 'v' (pointer to the variable of field type)
+func (d *Decoder) Decode(v interface{}) error {
+	value := reflect.ValueOf(v)
+
+	if value.Kind() != reflect.Ptr || value.IsNil() {
+		return errors.New("Incorrect type of the destination (expect pointer)")
+	}
+
+	return d.next(value.Elem())
+}
+
+func (d *Decoder) next(value reflect.Value) (err error) {
+	defer recoverError(&err)
+
+	if d.i >= d.n {
+		return io.EOF
+	}
+
+	// threshold is global. it could be changed by another packet
+	threshold = d.threshold
+
+	decode_loop(&d.buffer, 1, func(int) reflect.Value { return value }, d.tail, nil)
+
+	for d.tail.next != nil {
+		d.tail = d.tail.next
+	}
+
+	d.i++
+	if d.i == d.n {
+		decodeTail(&d.buffer, d.tail_first)
+		decodeChecksum(&d.buffer)
+		d.buffer.skipIndex()
+	}
+
+	return nil
+}
@@ -25,41 +25,200 @@
 package llsn
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"io"
+	"math"
+	"math/big"
 	"os"
 	"reflect"
+	"strconv"
 	"time"
 	"unicode/utf8"
 )
 
-func encode_ext(value reflect.Value, channel chan []byte, threshold uint16) {
+func encode_ext(value reflect.Value, w io.Writer, threshold uint16, canonical bool) {
+	encodePacket(value, packetLayout(value.Type()), w, threshold, canonical)
+}
+
+// packetLayout returns the layout of struct type 't' encoded field by field.
+// struct with field IDs, array or scalar value is encoded as the single
+// field (nil)
+func packetLayout(t reflect.Type) *structInfo {
+	if isRecord(t) {
+		if si := getStructInfo(t); si.ids == nil {
+			return si
+		}
+	}
+	return nil
+}
+
+// encodePacket encodes 'value' with the 'layout' of packet (see packetLayout)
+func encodePacket(value reflect.Value, layout *structInfo, w io.Writer,
+	threshold uint16, canonical bool) {
+
+	var tail_first *tailElement
+
+	tail_first = &tailElement{}
+
+	_, sizing := w.(*sizeWriter)
+	opts := encodeOpts{canonical: canonical, digests: digests && !canonical, sizing: sizing,
+		legacy: version == VERSION && !canonical}
+
+	n := uint64(1)
+	index := func(int) reflect.Value { return value }
+
+	if layout != nil {
+		n = uint64(len(layout.fields))
+		index = layout.index(value)
+	}
+
+	// encode version and threshold (see header.go). canonical packet has no
+	// tail and features
+	var flags byte
+	var c Compressor
+
+	if canonical {
+		threshold = 0
+		tail_first = nil
+	} else if compression != COMPRESS_NONE {
+		if c = lookupCompressor(compression); c == nil {
+			panic("compressor ID " + strconv.Itoa(int(compression)) + " is not registered")
+		}
+		flags |= flag_compressed
+	}
+	if checksums && !canonical {
+		flags |= flag_checksum
+	}
+	if opts.digests {
+		flags |= flag_digest
+	}
+	if indexed && c == nil && !canonical {
+		flags |= flag_index
+	}
+	flags |= typeFlags(value.Type(), opts)
+
+	// canonical packet has the header of the version its features require
+	// regardless of the pinned version
+	pinned := version
+	if canonical {
+		pinned = 0
+	}
+	header := encodeHeader(threshold, flags, compression, pinned)
+	opts.v1 = header[0]>>4 == VERSION
+
+	w.Write(header)
+
+	var index_trailer []byte
+
+	body := func(w io.Writer) {
+		if c != nil {
+			// the rest is written to the compressor
+			cw, err := c.NewWriter(w)
+			if err != nil {
+				panic(err)
+			}
+			defer func() {
+				if err := cw.Close(); err != nil {
+					panic(err)
+				}
+			}()
+			w = cw
+		}
+
+		w.Write(EncodeUNumber(uint64(n)))
+
+		if flags&flag_index != 0 {
+			index_trailer = encodeIndexed(w, value, n, index, tail_first,
+				uint64(len(header)), opts)
+			return
+		}
+
+		encode_loop(w, value, n, index, tail_first, opts)
+		if tail_first != nil {
+			encodeTail(w, tail_first, opts)
+		}
+	}
+
+	if flags&flag_checksum != 0 {
+		encodeChecksum(w, header, body)
+	} else {
+		body(w)
+	}
+
+	if index_trailer != nil {
+		w.Write(index_trailer)
+	}
+}
+
+// encodeTail writes the tailed data of the elements after 'tail_first'
+func encodeTail(w io.Writer, tail_first *tailElement, opts encodeOpts) {
+	var tail *tailElement
+
+	// Tail processing (> threshold).
+	if tail_first.next != nil {
+
+		for tail = tail_first.next; tail != nil; tail = tail.next {
+			switch tv := tail.value.Interface().(type) {
+			case File:
+				file_to_writer(tv, w, opts.digests)
+			case Blob:
+				w.Write([]byte(tv))
+			case string:
+				w.Write([]byte(tv))
+			default:
+				panic("wrong tail type")
+
+			}
+		}
+	}
+}
+
+// encode_loop encodes 'n' items of the 'value' with its own types tree.
+// huge data are appended to the 'tail'. tail encoding is disabled if it's nil
+func encode_loop(w io.Writer, value reflect.Value, n uint64,
+	index func(int) reflect.Value, tail *tailElement, opts encodeOpts) {
 
 	var stack *stackElement // = &stackElement{}
-	var tail, tail_first *tailElement
 	var tt *typesTree = &typesTree{}
 	var nullflags []byte
 	var mdf bool = false // multidimensional array flag
-	var index func(int) reflect.Value
-
-	tail = &tailElement{}
-	tail_first = tail
+	var stream *streamLevel
+	var stops []func() // iterators of streams
 
-	defer close(channel)
+	// iterators are released even if the encoding fails
+	defer func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}()
 
 	i := uint64(0)
-	n := uint64(value.NumField())
-
-	index = value.Field
-
-	// encode version and threshold
-	channel <- []byte{byte(((threshold >> 8) & 0xf) | (VERSION << 4)), byte(threshold)}
-	channel <- EncodeUNumber(uint64(n))
 
 	// because of Go has no tail recoursion we use "for" loop to emulate it
 	for {
 
 		if i >= n {
 
+			if stream != nil {
+				// next chunk of stream. the producer may be slow, so the
+				// data encoded so far are sent before it
+				flushWriter(w)
+				chunk := stream.next()
+				w.Write(EncodeUNumber(uint64(chunk.Len())))
+
+				if chunk.Len() > 0 {
+					i = uint64(0)
+					n = uint64(chunk.Len())
+					index = chunk.Index
+					value = chunk
+					nullflags = encodeNullFlags(chunk, true, opts.legacy)
+					continue
+				}
+
+				tail = stream.tail
+			}
+
 			if stack == nil {
 				break
 			}
@@ -70,6 +229,7 @@ func encode_ext(value reflect.Value, channel chan []byte, threshold uint16) {
 			value = stack.value
 			index = stack.index
 			nullflags = stack.nullflags
+			stream = stack.stream
 
 			stack = stack.parent
 			tt = tt.parent.next
@@ -85,7 +245,7 @@ func encode_ext(value reflect.Value, channel chan []byte, threshold uint16) {
 
 			// every 8 items should leads by nullflag byte
 			if i%8 == 0 {
-				channel <- []byte{nullflags[i/8]}
+				w.Write([]byte{nullflags[i/8]})
 			}
 
 			// skip value if its nil.
@@ -103,6 +263,70 @@ func encode_ext(value reflect.Value, channel chan []byte, threshold uint16) {
 		// process over here
 	dereference:
 
+		// registered types (time.Duration, net.IP, ...) have to be checked
+		// before the kind of value. see RegisterExt
+		ext := encodingExt(field.Type(), opts.legacy)
+		if ext == nil && field.Kind() == reflect.Ptr && field.IsNil() {
+			ext = encodingExt(field.Type().Elem(), opts.legacy)
+		}
+
+		if ext != nil {
+			isnil := (field.Kind() == reflect.Ptr || field.Kind() == reflect.Slice) && field.IsNil()
+
+			if tt.ttype == type_undefined {
+				if isnil {
+					w.Write([]byte{type_ext_null})
+				} else {
+					w.Write([]byte{type_ext})
+				}
+
+				// extension ID is written once like a type
+				w.Write(EncodeUNumber(ext.id))
+				tt.n = ext.id
+				tt = tt.append(type_ext)
+			} else {
+				tt = tt.next
+			}
+
+			if !isnil {
+				w.Write(encodeExt(ext, field))
+			}
+
+			i++
+			continue
+		}
+
+		if field.Kind() == reflect.Struct && field.Type().Implements(streamerType) {
+			stack = &stackElement{stack, i + 1, n, value, index, nullflags, nil, stream}
+
+			if tt.ttype == type_undefined {
+				w.Write([]byte{type_stream})
+				tt = tt.addchild(type_stream)
+				tt.next = tt
+			} else {
+				tt = tt.child
+			}
+
+			// the elements are taken from the iterator, so the stream can't
+			// be counted without consuming it
+			if opts.sizing {
+				panic("Size doesn't count the Stream (" + field.Type().String() + ")")
+			}
+
+			// chunks are read at the top of loop. tail encoding is
+			// disabled for the elements
+			next, stop := field.Interface().(streamer).chunks()
+			stream = &streamLevel{next: next, tail: tail}
+			stops = append(stops, stop)
+			tail = nil
+			mdf = true
+
+			i = uint64(0)
+			n = uint64(0)
+			nullflags = nil
+			continue
+		}
+
 		switch field.Kind() {
 		case reflect.Array, reflect.Slice:
 
@@ -114,24 +338,24 @@ func encode_ext(value reflect.Value, channel chan []byte, threshold uint16) {
 					var blob Blob
 
 					if tt.ttype == type_undefined {
-						channel <- []byte{type_blob}
+						w.Write([]byte{type_blob})
 						tt = tt.append(type_blob)
 					} else {
 						tt = tt.next
 					}
 
 					blen, blob, tail = encodeBlob(a, tail)
-					channel <- EncodeUNumber(blen)
+					w.Write(EncodeUNumber(blen))
 
 					// is exceed the threshold limit?
 					if blob != nil {
-						channel <- blob
+						w.Write(blob)
 					}
 
 				} else {
 					// blob value is nil
 					if tt.ttype == type_undefined {
-						channel <- []byte{type_blob_null}
+						w.Write([]byte{type_blob_null})
 						tt = tt.append(type_blob)
 					} else {
 						tt = tt.next
@@ -145,9 +369,10 @@ func encode_ext(value reflect.Value, channel chan []byte, threshold uint16) {
 
 					// FIXME: tail optimization -> dont increase 'stack' if
 					// the i'th element is the last one in array
-					stack = &stackElement{stack, i + 1, n, value, index, nullflags}
+					stack = &stackElement{stack, i + 1, n, value, index, nullflags, nil, stream}
+					stream = nil
 
-					nullflags = encodeNullFlags(field, mdf)
+					nullflags = encodeNullFlags(field, mdf, opts.legacy)
 					if nullflags != nil {
 						ta = type_arrayn
 					}
@@ -163,12 +388,12 @@ func encode_ext(value reflect.Value, channel chan []byte, threshold uint16) {
 					if tt.ttype == type_undefined {
 						tt = tt.addchild(ta)
 						tt.next = tt
-						channel <- []byte{byte(ta)}
+						w.Write([]byte{byte(ta)})
 					} else {
 						tt = tt.child
 					}
 
-					channel <- EncodeUNumber(uint64(n))
+					w.Write(EncodeUNumber(uint64(n)))
 					continue
 
 				} else {
@@ -176,7 +401,7 @@ func encode_ext(value reflect.Value, channel chan []byte, threshold uint16) {
 					var ta, tan int
 
 					switch field.Type().Elem().Kind() {
-					case reflect.Slice, reflect.Ptr:
+					case reflect.Slice, reflect.Ptr, reflect.Interface:
 						ta = type_arrayn
 						tan = type_arrayn_null
 					default:
@@ -186,7 +411,7 @@ func encode_ext(value reflect.Value, channel chan []byte, threshold uint16) {
 
 					if tt.ttype == type_undefined {
 						tt.ttype = ta
-						channel <- []byte{byte(tan)}
+						w.Write([]byte{byte(tan)})
 					}
 
 					if tt.child == nil {
@@ -206,21 +431,59 @@ func encode_ext(value reflect.Value, channel chan []byte, threshold uint16) {
 
 			switch ct := field.Interface().(type) {
 			case time.Time:
+				mode := datemode
+				if opts.canonical {
+					mode = DATE_LOSSLESS
+					ct = ct.UTC()
+				}
+
+				if mode == DATE_COMPACT {
+					if tt.ttype == type_undefined {
+						w.Write([]byte{type_date})
+						tt = tt.append(type_date)
+					} else {
+						tt = tt.next
+					}
+
+					w.Write(EncodeDate(&ct))
+					break
+				}
+
 				if tt.ttype == type_undefined {
-					channel <- []byte{type_date}
-					tt = tt.append(type_date)
+					w.Write([]byte{type_ndate})
+					tt = tt.append(type_ndate)
 				} else {
 					tt = tt.next
 				}
 
-				channel <- EncodeDate(&ct)
+				w.Write(EncodeDateNano(&ct, mode == DATE_ZONE))
+
+			case big.Int:
+				if tt.ttype == type_undefined {
+					w.Write([]byte{type_bignumber})
+					tt = tt.append(type_bignumber)
+				} else {
+					tt = tt.next
+				}
+
+				w.Write(EncodeBigNumber(&ct))
+
+			case big.Float:
+				if tt.ttype == type_undefined {
+					w.Write([]byte{type_bigfloat})
+					tt = tt.append(type_bigfloat)
+				} else {
+					tt = tt.next
+				}
+
+				w.Write(EncodeBigFloat(&ct))
 
 			case File:
 				var tailed bool = false
 				var bin []byte
 
 				if tt.ttype == type_undefined {
-					channel <- []byte{type_file}
+					w.Write([]byte{type_file})
 					tt = tt.append(type_file)
 				} else {
 					tt = tt.next
@@ -229,35 +492,46 @@ func encode_ext(value reflect.Value, channel chan []byte, threshold uint16) {
 				tailed, bin, tail = encodeFile(ct, tail)
 
 				// write file name and size
-				channel <- bin
+				w.Write(bin)
 				// write body of file if itsnt tailed
 				if !tailed {
-					file_to_channel(ct, channel)
+					file_to_writer(ct, w, opts.digests)
 				}
 
 			default:
-				stack = &stackElement{stack, i + 1, n, value, index, nullflags}
+				stack = &stackElement{stack, i + 1, n, value, index, nullflags, nil, stream}
+				stream = nil
 
 				i = uint64(0)
-				n = uint64(field.NumField())
-				index = field.Field
+				si := getStructInfo(field.Type())
+				ids := si.ids
+
+				n = uint64(len(si.fields))
+				index = si.index(field)
 				value = field
 				nullflags = nil
 
+				ts := type_struct
+				if ids != nil {
+					ts = type_structid
+				}
+
 				if tt.ttype == type_undefined {
-					channel <- []byte{type_struct}
-					channel <- EncodeUNumber(uint64(n))
+					w.Write([]byte{byte(ts)})
+					w.Write(EncodeUNumber(uint64(n)))
+					encodeIDs(w, ids)
 					tt.n = n
-					tt = tt.addchild(type_struct)
+					tt = tt.addchild(ts)
 
 				} else {
 
 					if tt.n == 0 {
-						channel <- EncodeUNumber(uint64(n))
+						w.Write(EncodeUNumber(uint64(n)))
+						encodeIDs(w, ids)
 						tt.n = n
 					} else {
 						// field types of struct seems to be already encoded
-						nullflags = encodeNullFlags(field, false)
+						nullflags = encodeNullFlags(field, false, opts.legacy)
 					}
 					tt = tt.child
 				}
@@ -265,51 +539,78 @@ func encode_ext(value reflect.Value, channel chan []byte, threshold uint16) {
 				continue
 			}
 
+		case reflect.Interface:
+			// nil interface
+			if field.IsNil() {
+				if tt.ttype == type_undefined {
+					w.Write([]byte{type_interface_null})
+					tt = tt.append(type_interface)
+				} else {
+					tt = tt.next
+				}
+				break
+			}
+
+			// concrete type of value could be different for every item, so
+			// it is written every time along with the value
+			if tt.ttype == type_undefined {
+				w.Write([]byte{type_interface})
+				tt = tt.append(type_interface)
+			} else {
+				tt = tt.next
+			}
+
+			w.Write(encodeInterface(field.Elem(), opts))
+
 		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 			// encode signed number
 			if tt.ttype == type_undefined {
-				channel <- []byte{type_number}
+				w.Write([]byte{type_number})
 				tt = tt.append(type_number)
 			} else {
 				tt = tt.next
 			}
 
-			channel <- EncodeNumber(int64(field.Int()))
+			w.Write(EncodeNumber(int64(field.Int())))
 
 		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 			// encode unsigned number
 			if tt.ttype == type_undefined {
-				channel <- []byte{type_unumber}
+				w.Write([]byte{type_unumber})
 				tt = tt.append(type_unumber)
 			} else {
 				tt = tt.next
 			}
-			channel <- EncodeUNumber(uint64(field.Uint()))
+			w.Write(EncodeUNumber(uint64(field.Uint())))
 
 		case reflect.Float32, reflect.Float64:
 			// encode float number
 			if tt.ttype == type_undefined {
-				channel <- []byte{type_float}
+				w.Write([]byte{type_float})
 				tt = tt.append(type_float)
 			} else {
 				tt = tt.next
 			}
 
-			channel <- EncodeFloat(float64(field.Float()))
+			if opts.v1 {
+				w.Write(encodeFloatV1(field.Float(), field.Type().Bits()))
+			} else {
+				w.Write(encodeFloat(field.Float(), field.Type().Bits()))
+			}
 
 		case reflect.Bool:
 			// encode boolean
 			if tt.ttype == type_undefined {
-				channel <- []byte{type_bool}
+				w.Write([]byte{type_bool})
 				tt = tt.append(type_bool)
 			} else {
 				tt = tt.next
 			}
 
 			if field.Bool() {
-				channel <- []byte{1}
+				w.Write([]byte{1})
 			} else {
-				channel <- []byte{0}
+				w.Write([]byte{0})
 			}
 
 		case reflect.String:
@@ -317,17 +618,17 @@ func encode_ext(value reflect.Value, channel chan []byte, threshold uint16) {
 			var binlen, bin []byte
 
 			if tt.ttype == type_undefined {
-				channel <- []byte{type_string}
+				w.Write([]byte{type_string})
 				tt = tt.append(type_string)
 			} else {
 				tt = tt.next
 			}
 
 			binlen, bin, tail = encodeString(field.String(), tail)
-			channel <- binlen // length of string in octet(bytes)
+			w.Write(binlen) // length of string in octet(bytes)
 			if bin != nil {
 				// string is not tailed. encode it
-				channel <- bin
+				w.Write(bin)
 			}
 
 		case reflect.Ptr:
@@ -336,7 +637,7 @@ func encode_ext(value reflect.Value, channel chan []byte, threshold uint16) {
 				case reflect.Int, reflect.Int16, reflect.Int32, reflect.Int64:
 					// nil value for number
 					if tt.ttype == type_undefined {
-						channel <- []byte{type_number_null}
+						w.Write([]byte{type_number_null})
 						tt = tt.append(type_number)
 					} else {
 						tt = tt.next
@@ -345,7 +646,7 @@ func encode_ext(value reflect.Value, channel chan []byte, threshold uint16) {
 				case reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 					//nil value for unsigned number
 					if tt.ttype == type_undefined {
-						channel <- []byte{type_unumber_null}
+						w.Write([]byte{type_unumber_null})
 						tt = tt.append(type_unumber)
 					} else {
 						tt = tt.next
@@ -354,7 +655,7 @@ func encode_ext(value reflect.Value, channel chan []byte, threshold uint16) {
 				case reflect.Float32, reflect.Float64:
 					// nil value for float
 					if tt.ttype == type_undefined {
-						channel <- []byte{type_float_null}
+						w.Write([]byte{type_float_null})
 						tt = tt.append(type_float)
 					} else {
 						tt = tt.next
@@ -363,7 +664,7 @@ func encode_ext(value reflect.Value, channel chan []byte, threshold uint16) {
 				case reflect.String:
 					// nil value for string
 					if tt.ttype == type_undefined {
-						channel <- []byte{type_string_null}
+						w.Write([]byte{type_string_null})
 						tt = tt.append(type_string)
 					} else {
 						tt = tt.next
@@ -372,7 +673,7 @@ func encode_ext(value reflect.Value, channel chan []byte, threshold uint16) {
 				case reflect.Bool:
 					// nil value for bool
 					if tt.ttype == type_undefined {
-						channel <- []byte{type_bool_null}
+						w.Write([]byte{type_bool_null})
 						tt = tt.append(type_bool)
 					} else {
 						tt = tt.next
@@ -383,8 +684,31 @@ func encode_ext(value reflect.Value, channel chan []byte, threshold uint16) {
 					case *time.Time:
 						// nil value for date
 						if tt.ttype == type_undefined {
-							channel <- []byte{type_date_null}
-							tt = tt.append(type_date)
+							if datemode == DATE_COMPACT && !opts.canonical {
+								w.Write([]byte{type_date_null})
+								tt = tt.append(type_date)
+							} else {
+								w.Write([]byte{type_ndate_null})
+								tt = tt.append(type_ndate)
+							}
+						} else {
+							tt = tt.next
+						}
+
+					case *big.Int:
+						// nil value for big number
+						if tt.ttype == type_undefined {
+							w.Write([]byte{type_bignumber_null})
+							tt = tt.append(type_bignumber)
+						} else {
+							tt = tt.next
+						}
+
+					case *big.Float:
+						// nil value for big float
+						if tt.ttype == type_undefined {
+							w.Write([]byte{type_bigfloat_null})
+							tt = tt.append(type_bigfloat)
 						} else {
 							tt = tt.next
 						}
@@ -392,7 +716,7 @@ func encode_ext(value reflect.Value, channel chan []byte, threshold uint16) {
 					case *File:
 						// nil value for file
 						if tt.ttype == type_undefined {
-							channel <- []byte{type_file_null}
+							w.Write([]byte{type_file_null})
 							tt = tt.append(type_file)
 						} else {
 							tt = tt.next
@@ -400,13 +724,18 @@ func encode_ext(value reflect.Value, channel chan []byte, threshold uint16) {
 
 					default:
 						// nil value for struct
+						ts := type_struct
+						if hasIDs(field.Type().Elem()) {
+							ts = type_structid
+						}
+
 						if tt.ttype == type_undefined {
-							tt.ttype = type_struct
-							channel <- []byte{type_struct_null}
+							tt.ttype = ts
+							w.Write([]byte{byte(255 - ts)})
 						}
 
 						if tt.child == nil {
-							tt.addchild(type_struct)
+							tt.addchild(ts)
 						}
 
 						tt = tt.next
@@ -431,26 +760,6 @@ func encode_ext(value reflect.Value, channel chan []byte, threshold uint16) {
 
 		i++
 	}
-
-	// Tail processing (> threshold).
-	if tail_first.next != nil {
-
-		for tail = tail_first.next; tail != nil; tail = tail.next {
-			switch tv := tail.value.Interface().(type) {
-			case File:
-				file_to_channel(tv, channel)
-			case Blob:
-				channel <- []byte(tv)
-			case string:
-				channel <- []byte(tv)
-			default:
-				panic("wrong tail type")
-
-			}
-		}
-	}
-
-	return
 }
 
 // encode tab:
@@ -540,23 +849,107 @@ func EncodeUNumber(number uint64) []byte {
 
 }
 
+// float encoding:
+//
+// 1B: scale (signed, -123..127)
+// 1..9B: significand (NUMBER)
+//
+// value = significand * 10^(-scale). example: 3.141596 -> 3141596*10(-6)
+// significand holds the shortest decimal representation which rounds back to
+// the same binary value, so the encoding is lossless for any finite float.
+//
+// reserved values of the scale byte:
+// 0x80 [NUMBER scale][NUMBER significand] - scale is out of the 1 byte range
+// 0x81 NaN
+// 0x82 +Inf
+// 0x83 -Inf
+// 0x84 -0
+//
+// the packets with the header of version 1 have the unsigned scale (0..255)
+// with no reserved values, see encodeFloatV1
+
 func EncodeFloat(f float64) []byte {
-	var i uint8
-	var p float64 = 10.0
+	return encodeFloat(f, 64)
+}
 
-	// calculate power of 10 for 'f' float number
-	// example: 3.141596 -> 3141596*10(-6)
-	// encoded: 1B:power of 10 and 1..9B:signed number for the value
+func EncodeFloat32(f float32) []byte {
+	return encodeFloat(float64(f), 32)
+}
 
-	for i = 1; ; i++ {
-		if f*p > float64(int(f*p)) {
-			p *= 10.0
-			continue
+func encodeFloat(f float64, bits int) []byte {
+	switch {
+	case math.IsNaN(f):
+		return []byte{float_nan}
+	case math.IsInf(f, 1):
+		return []byte{float_inf}
+	case math.IsInf(f, -1):
+		return []byte{float_ninf}
+	case f == 0 && math.Signbit(f):
+		return []byte{float_nzero}
+	}
+
+	significand, scale := splitFloat(f, bits)
+
+	if scale < float_scale_min || scale > float_scale_max {
+		bin := append([]byte{float_scale_ext}, EncodeNumber(int64(scale))...)
+		return append(bin, EncodeNumber(significand)...)
+	}
+
+	return append([]byte{byte(int8(scale))}, EncodeNumber(significand)...)
+}
+
+// encodeFloatV1 encodes the float for the packet with the header of version 1
+// (the old decoders read the scale as unsigned). panics if the value can't be
+// encoded this way (NaN, Inf, the value doesn't fit 64 bits with no fraction
+// or has more than 255 decimal places). -0 is encoded as 0
+func encodeFloatV1(f float64, bits int) []byte {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		panic("float " + strconv.FormatFloat(f, 'g', -1, bits) +
+			" can't be encoded with the header of version 1")
+	}
+
+	significand, scale := splitFloat(f, bits)
+
+	for ; scale < 0; scale++ {
+		if significand > math.MaxInt64/10 || significand < math.MinInt64/10 {
+			panic("float " + strconv.FormatFloat(f, 'g', -1, bits) +
+				" can't be encoded with the header of version 1")
 		}
+		significand *= 10
+	}
 
-		break
+	if scale > math.MaxUint8 {
+		panic("float " + strconv.FormatFloat(f, 'g', -1, bits) +
+			" can't be encoded with the header of version 1")
 	}
-	return append([]byte{i}, EncodeNumber(int64(f*p))...)
+
+	return append([]byte{byte(scale)}, EncodeNumber(significand)...)
+}
+
+// splitFloat returns the shortest decimal representation of the finite
+// float: value = significand * 10^(-scale)
+func splitFloat(f float64, bits int) (significand int64, scale int) {
+	var digits, exp int
+
+	// shortest representation: [-]d.ddddde±dd
+	// float32 values are formatted with their own precision to avoid
+	// the garbage digits of float64 conversion (0.1 -> 0.10000000149011612)
+	b := strconv.AppendFloat(make([]byte, 0, 32), f, 'e', -1, bits)
+	e := bytes.IndexByte(b, 'e')
+	exp, _ = strconv.Atoi(string(b[e+1:]))
+
+	for _, c := range b[:e] {
+		if c >= '0' && c <= '9' {
+			significand = significand*10 + int64(c-'0')
+			digits++
+		}
+	}
+
+	if b[0] == '-' {
+		significand = -significand
+	}
+
+	return significand, digits - 1 - exp
 }
 
 func encodeString(s string, tail *tailElement) ([]byte, []byte, *tailElement) {
@@ -619,23 +1012,19 @@ func EncodeDate(t *time.Time) []byte {
 	date |= int64(sec) << 22
 
 	// range of nanoseconds: 0..999999999. [https://golang.org/src/time/time.go]
-	// it can be stored in 30bits.
-	// max range of LLSN Data.nsec: 0..4095 (12 bits)
-	// truncate it to fit the value in 12 bits.
+	// it can't be stored in 10 bits, so truncate it to milliseconds.
+	// use EncodeDateNano to keep the nanoseconds
 	nsec = t.Nanosecond() / 1000000
-	if nsec > 4095 {
-		date |= int64(nsec/10) << 12
-	} else {
-		date |= int64(nsec) << 12
-	}
+	date |= int64(nsec) << 12
 
-	// timezone. hours, mins
-	date |= int64(zone/3600) << 6
-	// only hours is signed
+	// timezone. hours, mins. only hours is signed, so the sign of
+	// offsets like -00:30 is lost
+	zone /= 60
+	date |= (int64(zone/60) & 0x3f) << 6
 	if zone < 0 {
 		zone *= -1
 	}
-	date |= int64(zone % 3600 / 60)
+	date |= int64(zone % 60)
 
 	for i := uint8(0); i < 8; i++ {
 		bin[i] = byte(date >> ((7 - i) * 8))
@@ -643,6 +1032,87 @@ func EncodeDate(t *time.Time) []byte {
 	return bin
 }
 
+// lossless date:
+//
+// 1..9B: seconds since the Unix epoch (NUMBER)
+// 1..5B: nanoseconds 0..999999999 (UNUMBER)
+// 1..9B: offset in seconds east of UTC (NUMBER)
+// 1..n : IANA zone name (UNUMBER length + string). zero length if it is
+//        omitted or the location has no name
+
+func EncodeDateNano(t *time.Time, zone bool) []byte {
+	var name string
+
+	_, offset := t.Zone()
+
+	bin := EncodeNumber(t.Unix())
+	bin = append(bin, EncodeUNumber(uint64(t.Nanosecond()))...)
+	bin = append(bin, EncodeNumber(int64(offset))...)
+
+	if zone {
+		name = t.Location().String()
+	}
+
+	bin = append(bin, EncodeUNumber(uint64(len(name)))...)
+	return append(bin, name...)
+}
+
+// big number:
+//
+// 1..9B: length of the magnitude in bytes (NUMBER). negative for the
+//        negative values, 0 for zero
+// 0..n : magnitude (big-endian)
+
+func EncodeBigNumber(x *big.Int) []byte {
+	magnitude := x.Bytes()
+
+	if x.Sign() < 0 {
+		return append(EncodeNumber(-int64(len(magnitude))), magnitude...)
+	}
+
+	return append(EncodeNumber(int64(len(magnitude))), magnitude...)
+}
+
+// big float:
+//
+// 1..9B: precision in bits (UNUMBER)
+// 1B   : flags. bits 0..2 - rounding mode, 3 - sign, 4..5 - form (0 - zero,
+//        1 - finite, 2 - infinity)
+// finite values are followed by
+// 1..n : mantissa (big number)
+// 1..9B: exponent (NUMBER). value = mantissa * 2^exponent
+
+func EncodeBigFloat(x *big.Float) []byte {
+	var flags byte = byte(x.Mode())
+
+	if x.Signbit() {
+		flags |= 1 << 3
+	}
+
+	bin := EncodeUNumber(uint64(x.Prec()))
+
+	switch {
+	case x.IsInf():
+		return append(bin, flags|bigfloat_inf<<4)
+
+	case x.Sign() == 0:
+		return append(bin, flags|bigfloat_zero<<4)
+	}
+
+	bin = append(bin, flags|bigfloat_finite<<4)
+
+	// x = mantissa * 2^exp, 0.5 <= |mantissa| < 1. shift the mantissa
+	// to get the integer value
+	mantissa := new(big.Float)
+	exp := x.MantExp(mantissa)
+	prec := int(mantissa.MinPrec())
+	mantissa.SetMantExp(mantissa, prec)
+	m, _ := mantissa.Int(nil)
+
+	bin = append(bin, EncodeBigNumber(m)...)
+	return append(bin, EncodeNumber(int64(exp-prec))...)
+}
+
 func encodeBlob(b Blob, tail *tailElement) (uint64, Blob, *tailElement) {
 	length := uint64(len(b))
 
@@ -725,15 +1195,23 @@ func pack_number(value interface{}, n uint8) []byte {
 // a[0] == nil set the first bit: 0b10000000
 // a[7] == nil set the  last one: 0b00000001
 // so, byteflag = 0b10000001
-func encodeNullFlags(v reflect.Value, force bool) []byte {
+// encodeIDs writes the field IDs of struct
+func encodeIDs(w io.Writer, ids []uint64) {
+	for _, id := range ids {
+		w.Write(EncodeUNumber(id))
+	}
+}
+
+func encodeNullFlags(v reflect.Value, force bool, legacy bool) []byte {
 	var method func(int) reflect.Value
 	var nelements func() int
 	var hasnil bool = force
 
 	switch v.Kind() {
 	case reflect.Struct:
-		method = v.Field
-		nelements = v.NumField
+		si := getStructInfo(v.Type())
+		method = si.index(v)
+		nelements = func() int { return len(si.fields) }
 
 	case reflect.Array, reflect.Slice:
 		method = v.Index
@@ -750,10 +1228,15 @@ func encodeNullFlags(v reflect.Value, force bool) []byte {
 
 	for i := 0; i < n; i++ {
 		val := method(i)
-		if (val.Kind() == reflect.Ptr || val.Kind() == reflect.Slice) && val.IsNil() {
-			// set 'nil' flag
-			flags[i/8] |= 1 << (7 - (uint(i) % 8))
-			hasnil = true
+		switch val.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Interface:
+			// empty slice is encoded as null as well (extensions keep it)
+			if val.IsNil() || (val.Kind() == reflect.Slice && val.Len() == 0 &&
+				encodingExt(val.Type(), legacy) == nil) {
+				// set 'nil' flag
+				flags[i/8] |= 1 << (7 - (uint(i) % 8))
+				hasnil = true
+			}
 		}
 	}
 
@@ -764,11 +1247,28 @@ func encodeNullFlags(v reflect.Value, force bool) []byte {
 	return nil
 }
 
-func file_to_channel(f File, channel chan []byte) {
+// file_to_writer writes the file data and the 'digest' of them (optional)
+func file_to_writer(f File, w io.Writer, digest bool) {
 	var readbytes int
 	var err error
 	var buffer []byte
 
+	if s, ok := w.(skipWriter); ok {
+		fi, err := os.Stat(f.Name)
+		if err != nil {
+			panic(err)
+		}
+
+		n := uint64(fi.Size())
+		if digest {
+			n += sha256.Size
+		}
+
+		if s.skip(n) {
+			return
+		}
+	}
+
 	buffer = make([]byte, 65536) // 64K
 
 	of, err := os.Open(f.Name)
@@ -777,16 +1277,24 @@ func file_to_channel(f File, channel chan []byte) {
 	}
 	defer of.Close()
 
+	h := sha256.New()
+
 	for {
 		readbytes, err = of.Read(buffer)
 		if readbytes > 0 {
-			channel <- buffer[:readbytes]
+			if digest {
+				h.Write(buffer[:readbytes])
+			}
+			w.Write(buffer[:readbytes])
 		}
 
 		switch err {
 		case nil:
 			continue
 		case io.EOF:
+			if digest {
+				w.Write(h.Sum(nil))
+			}
 			return
 		default:
 			panic(err)
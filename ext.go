@@ -0,0 +1,248 @@
+// Golang support for LLSN - Allyst's data interchange format.
+// LLSN specification http://allyst.org/opensource/llsn/
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// copyright (C) 2015 Allyst Inc. http://allyst.com
+// author Taras Halturin <halturin@allyst.com>
+
+package llsn
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Extensions map the Go types with no native LLSN representation to the
+// compact binary form. Encoded value of extension:
+//
+// 1B   : type_ext (type_ext_null)
+// 1..9B: extension ID (UNUMBER)
+// 1..9B: length of payload (UNUMBER). absent for the null value
+// 0..n : payload
+//
+// type code and extension ID are written once, like any other type
+
+// IDs of the built-in extensions. IDs 1..63 are reserved
+const (
+	EXT_DURATION = 1 // time.Duration. payload is NUMBER of nanoseconds
+	EXT_IP       = 2 // net.IP. 4 or 16 bytes
+	EXT_URL      = 3 // url.URL. string
+	EXT_UUID     = 4 // UUID. 16 bytes
+)
+
+// UUID is encoded as the extension EXT_UUID. The other arrays of 16 bytes are
+// the regular arrays
+type UUID [16]byte
+
+type extension struct {
+	id      uint64
+	t       reflect.Type
+	encode  func(interface{}) []byte
+	decode  func([]byte) (interface{}, error)
+	builtin bool // the type has the encoding of version 1. see encodingExt
+}
+
+var extensions = struct {
+	sync.RWMutex
+	types map[reflect.Type]*extension
+	ids   map[uint64]*extension
+}{
+	types: make(map[reflect.Type]*extension),
+	ids:   make(map[uint64]*extension),
+}
+
+// RegisterExt binds the type of 'v' to the extension 'id'. The values of
+// this type are converted to the payload by 'encode' and restored by 'decode',
+// which should return the value of the same type (or convertible to it).
+// The pointers to this type are nullable. Panics if the type or ID
+// is already registered.
+func RegisterExt(id uint64, v interface{}, encode func(interface{}) []byte,
+	decode func([]byte) (interface{}, error)) {
+
+	registerExt(&extension{id, reflect.TypeOf(v), encode, decode, false})
+}
+
+func registerExt(ext *extension) {
+	id, t := ext.id, ext.t
+
+	if id == 0 {
+		panic("extension ID should be greater than 0")
+	}
+
+	extensions.Lock()
+	defer extensions.Unlock()
+
+	if _, exist := extensions.ids[id]; exist {
+		panic(fmt.Sprintf("extension ID %d is already registered", id))
+	}
+
+	if _, exist := extensions.types[t]; exist {
+		panic("type " + t.String() + " is already registered")
+	}
+
+	extensions.ids[id] = ext
+	extensions.types[t] = ext
+}
+
+func lookupExt(t reflect.Type) *extension {
+	extensions.RLock()
+	defer extensions.RUnlock()
+	return extensions.types[t]
+}
+
+// encodingExt returns the extension the values of type 't' are encoded with.
+// the built-in extensions are not used by the 'legacy' encoding (version 1 is
+// pinned), their types are encoded as the regular values (time.Duration is
+// NUMBER, UUID is the array of UNUMBER, ...)
+func encodingExt(t reflect.Type, legacy bool) *extension {
+	ext := lookupExt(t)
+	if ext != nil && legacy && ext.builtin {
+		return nil
+	}
+	return ext
+}
+
+func lookupExtID(id uint64) *extension {
+	extensions.RLock()
+	defer extensions.RUnlock()
+	return extensions.ids[id]
+}
+
+func encodeExt(ext *extension, field reflect.Value) []byte {
+	if field.Kind() == reflect.Ptr {
+		field = field.Elem()
+	}
+
+	payload := ext.encode(field.Interface())
+	return append(EncodeUNumber(uint64(len(payload))), payload...)
+}
+
+func decodeExt(buffer *decodeBuffer, id uint64, field reflect.Value) {
+	var value reflect.Value
+
+	payload := buffer.read(decodeUNumber(buffer))
+
+	if !field.IsValid() {
+		return
+	}
+
+	ext := lookupExtID(id)
+	if ext == nil {
+		// keep the payload of unknown extension for the generic value
+		if field.Kind() == reflect.Interface {
+			field.Set(reflect.ValueOf(Blob(append([]byte(nil), payload...))))
+			return
+		}
+		panic(fmt.Sprintf("unknown extension ID %d", id))
+	}
+
+	v, err := ext.decode(payload)
+	if err != nil {
+		panic(err)
+	}
+
+	value = reflect.ValueOf(v)
+
+	target := field.Type()
+	if target.Kind() == reflect.Ptr {
+		target = target.Elem()
+	}
+
+	if !value.Type().ConvertibleTo(target) {
+		if strict {
+			oops(ERR_TYPE_MISMATCH, fmt.Sprintf("extension %d can't be decoded into %s",
+				id, field.Type()))
+		}
+		return
+	}
+
+	if field.Kind() == reflect.Ptr {
+		pvalue := reflect.New(field.Type().Elem())
+		pvalue.Elem().Set(value.Convert(field.Type().Elem()))
+		field.Set(pvalue)
+		return
+	}
+
+	field.Set(value.Convert(field.Type()))
+}
+
+// registerBuiltinExt registers the built-in extension (see encodingExt)
+func registerBuiltinExt(id uint64, v interface{}, encode func(interface{}) []byte,
+	decode func([]byte) (interface{}, error)) {
+
+	registerExt(&extension{id, reflect.TypeOf(v), encode, decode, true})
+}
+
+func init() {
+	registerBuiltinExt(EXT_DURATION, time.Duration(0),
+		func(v interface{}) []byte {
+			return EncodeNumber(int64(v.(time.Duration)))
+		},
+		func(b []byte) (interface{}, error) {
+			return time.Duration(DecodeNumber(b)), nil
+		})
+
+	registerBuiltinExt(EXT_IP, net.IP{},
+		func(v interface{}) []byte {
+			ip := v.(net.IP)
+			if ip4 := ip.To4(); ip4 != nil {
+				return ip4
+			}
+			return ip
+		},
+		func(b []byte) (interface{}, error) {
+			if len(b) != net.IPv4len && len(b) != net.IPv6len {
+				return nil, errors.New("wrong length of IP address")
+			}
+			return net.IP(append([]byte(nil), b...)), nil
+		})
+
+	registerBuiltinExt(EXT_URL, url.URL{},
+		func(v interface{}) []byte {
+			u := v.(url.URL)
+			return []byte(u.String())
+		},
+		func(b []byte) (interface{}, error) {
+			u, err := url.Parse(string(b))
+			if err != nil {
+				return nil, err
+			}
+			return *u, nil
+		})
+
+	registerBuiltinExt(EXT_UUID, UUID{},
+		func(v interface{}) []byte {
+			uuid := v.(UUID)
+			return uuid[:]
+		},
+		func(b []byte) (interface{}, error) {
+			var uuid UUID
+			if len(b) != len(uuid) {
+				return nil, errors.New("wrong length of UUID")
+			}
+			copy(uuid[:], b)
+			return uuid, nil
+		})
+}
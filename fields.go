@@ -0,0 +1,391 @@
+// Golang support for LLSN - Allyst's data interchange format.
+// LLSN specification http://allyst.org/opensource/llsn/
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// copyright (C) 2015 Allyst Inc. http://allyst.com
+// author Taras Halturin <halturin@allyst.com>
+
+package llsn
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Struct fields are matched by position unless every field of the struct
+// has the numeric ID in the tag:
+//
+//	type Order struct {
+//		ID    int64  `llsn:"id=1"`
+//		Title string `llsn:"id=2"`
+//	}
+//
+// Encoded struct with field IDs:
+//
+// 1B   : type_structid (type_structid_null)
+// 1..9B: number of fields (UNUMBER)
+// n*1..9B: field IDs (UNUMBER)
+// ...  : fields
+//
+// number of fields and IDs are written once, like the type codes. Decoder
+// matches the fields by ID, so the order of fields doesn't matter and the
+// unknown IDs are discarded. The top level struct with field IDs is encoded
+// as a packet with the single field of type_structid.
+//
+// With "flatten" option the fields of embedded structs are promoted to the
+// parent, like encoding/json does. Among the promoted fields with the same
+// name the shallowest one wins, then the one with the llsn tag, otherwise
+// all of them are dropped. Embedded struct with the llsn tag is encoded as
+// the regular field. Both sides have to use the same option.
+
+// structField describes the encoded field of struct
+type structField struct {
+	index  []int // index sequence of the (promoted) field
+	name   string
+	id     uint64 // 0 - no ID
+	tagged bool
+	t      reflect.Type
+}
+
+// structInfo is the parsed layout of struct type
+type structInfo struct {
+	fields []structField
+	ids    []uint64       // field IDs in order of encoding. nil - positional
+	byid   map[uint64]int // field ID -> number of field
+	flat   bool           // has promoted or dropped fields
+}
+
+// layouts of struct types. [0] - regular, [1] - with "flatten" option
+var structInfos [2]sync.Map // reflect.Type -> *structInfo
+
+// getStructInfo returns the cached layout of the struct type 't'. Panics if
+// the field IDs are inconsistent.
+func getStructInfo(t reflect.Type) *structInfo {
+	cache := &structInfos[0]
+	if flatten {
+		cache = &structInfos[1]
+	}
+
+	if si, ok := cache.Load(t); ok {
+		return si.(*structInfo)
+	}
+
+	si := &structInfo{fields: typeFields(t, flatten)}
+	nid := 0
+
+	for i, f := range si.fields {
+		if f.id > 0 {
+			nid++
+		}
+		if len(f.index) > 1 || f.index[0] != i {
+			si.flat = true
+		}
+	}
+
+	if nid > 0 {
+		if nid != len(si.fields) {
+			panic(fmt.Sprintf("llsn: not all fields of %s have ID", t))
+		}
+
+		si.ids = make([]uint64, len(si.fields))
+		si.byid = make(map[uint64]int, len(si.fields))
+
+		for i, f := range si.fields {
+			if _, ok := si.byid[f.id]; ok {
+				panic(fmt.Sprintf("llsn: duplicate ID %d in %s", f.id, t))
+			}
+			si.ids[i] = f.id
+			si.byid[f.id] = i
+		}
+	}
+
+	v, _ := cache.LoadOrStore(t, si)
+	return v.(*structInfo)
+}
+
+// typeFields returns the fields of struct type 't' in order of encoding.
+// the embedded structs are walked breadth-first if 'flat' is true
+func typeFields(t reflect.Type, flat bool) []structField {
+	type embedded struct {
+		t     reflect.Type
+		index []int
+	}
+
+	var fields []structField
+	var next = []embedded{{t, nil}}
+	var visited = map[reflect.Type]bool{}
+
+	for depth := 0; len(next) > 0; depth++ {
+		current := next
+		next = nil
+
+		// the type embedded twice at the same depth gives the ambiguous
+		// fields, only the shallower ones are skipped
+		level := map[reflect.Type]bool{}
+
+		for _, e := range current {
+			if visited[e.t] {
+				continue
+			}
+			level[e.t] = true
+
+			for i := 0; i < e.t.NumField(); i++ {
+				f := e.t.Field(i)
+				tag := f.Tag.Get("llsn")
+				index := append(append([]int{}, e.index...), i)
+
+				if flat && f.Anonymous && tag == "" && flattenable(f.Type) {
+					ft := f.Type
+					if ft.Kind() == reflect.Ptr {
+						ft = ft.Elem()
+					}
+					next = append(next, embedded{ft, index})
+					continue
+				}
+
+				if depth > 0 && !f.IsExported() {
+					continue
+				}
+
+				sf := structField{index: index, name: f.Name, tagged: tag != "", t: f.Type}
+
+				if id, ok := tagOption(tag, "id"); ok {
+					n, err := strconv.ParseUint(id, 10, 64)
+					if err != nil || n == 0 {
+						panic(fmt.Sprintf("llsn: invalid ID of field %s.%s", e.t, f.Name))
+					}
+					sf.id = n
+				}
+
+				fields = append(fields, sf)
+			}
+		}
+
+		for t := range level {
+			visited[t] = true
+		}
+	}
+
+	if !flat {
+		return fields
+	}
+
+	// order of declaration
+	sort.Slice(fields, func(i, j int) bool {
+		a, b := fields[i].index, fields[j].index
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+
+	// resolve the name conflicts
+	var out []structField
+	for i := range fields {
+		if f, ok := dominantField(fields, fields[i].name); ok && f == &fields[i] {
+			out = append(out, *f)
+		}
+	}
+
+	return out
+}
+
+// dominantField returns the field 'name' that wins the conflict: the
+// shallowest one, then the tagged one. returns false if it's ambiguous
+func dominantField(fields []structField, name string) (*structField, bool) {
+	var dominant *structField
+	var ambiguous bool
+
+	for i := range fields {
+		f := &fields[i]
+		if f.name != name {
+			continue
+		}
+
+		switch {
+		case dominant == nil, len(f.index) < len(dominant.index):
+			dominant, ambiguous = f, false
+		case len(f.index) > len(dominant.index):
+		case f.tagged && !dominant.tagged:
+			dominant, ambiguous = f, false
+		case f.tagged == dominant.tagged:
+			ambiguous = true
+		}
+	}
+
+	return dominant, dominant != nil && !ambiguous
+}
+
+// flattenable returns true for the embedded struct type with no special
+// encoding
+func flattenable(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t.Kind() != reflect.Struct || lookupExt(t) != nil {
+		return false
+	}
+
+	switch t {
+	case dateType, fileType, bignumberType, bigfloatType, valueType:
+		return false
+	}
+
+	return true
+}
+
+// isRecord returns true for the struct type encoded field by field. the
+// top level value of other types is encoded as the single field
+func isRecord(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && flattenable(t) && !t.Implements(streamerType)
+}
+
+// tagOption returns the value of 'name=value' option of the llsn tag
+func tagOption(tag, name string) (string, bool) {
+	for _, opt := range strings.Split(tag, ",") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(opt), "="); ok && k == name {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// hasIDs returns true for the struct type with field IDs
+func hasIDs(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && getStructInfo(t).ids != nil
+}
+
+// index returns the index function for encoding the struct 'v'. promoted
+// fields of nil embedded pointers are zero values
+func (si *structInfo) index(v reflect.Value) func(int) reflect.Value {
+	if !si.flat {
+		return v.Field
+	}
+
+	return func(i int) reflect.Value {
+		f := &si.fields[i]
+		e := v
+
+		for k, x := range f.index {
+			if k > 0 && e.Kind() == reflect.Ptr {
+				if e.IsNil() {
+					return reflect.Zero(f.t)
+				}
+				e = e.Elem()
+			}
+			e = e.Field(x)
+		}
+
+		return e
+	}
+}
+
+// field returns the field 'i' of struct 'v' for decoding. nil embedded
+// pointers are allocated
+func (si *structInfo) field(v reflect.Value, i int) reflect.Value {
+	f := &si.fields[i]
+
+	if len(f.index) == 1 {
+		return v.Field(f.index[0])
+	}
+
+	for k, x := range f.index {
+		if k > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					// unexported embedded pointer
+					return reflect.Value{}
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+
+	return v
+}
+
+// structIndex returns the index function for decoding the struct with 'n'
+// positional fields into 'v'. missing fields keep zero values, extra fields
+// are discarded
+func structIndex(v reflect.Value, n uint64) func(int) reflect.Value {
+	si := getStructInfo(v.Type())
+	nf := len(si.fields)
+
+	if strict && uint64(nf) != n {
+		oops(ERR_FIELDS_MISMATCH, fmt.Sprintf("%s has %d fields, received %d",
+			v.Type(), nf, n))
+	}
+
+	if uint64(nf) >= n && !si.flat {
+		return v.Field
+	}
+
+	return func(i int) reflect.Value {
+		if i < nf {
+			return si.field(v, i)
+		}
+		return reflect.Value{}
+	}
+}
+
+// idIndex returns the index function for decoding the struct with field
+// 'ids' into 'v'. missing fields keep zero values, unknown fields are
+// discarded
+func idIndex(v reflect.Value, ids []uint64) func(int) reflect.Value {
+	si := getStructInfo(v.Type())
+
+	if si.ids == nil {
+		// destination has no field IDs. match by position
+		return structIndex(v, uint64(len(ids)))
+	}
+
+	position := make([]int, len(ids))
+	found := 0
+
+	for i, id := range ids {
+		if k, ok := si.byid[id]; ok {
+			position[i] = k
+			found++
+		} else {
+			position[i] = -1
+		}
+	}
+
+	if strict && (found != len(ids) || found != len(si.fields)) {
+		oops(ERR_FIELDS_MISMATCH, fmt.Sprintf("%s has field IDs %v, received %v",
+			v.Type(), si.ids, ids))
+	}
+
+	return func(i int) reflect.Value {
+		if i < len(position) && position[i] >= 0 {
+			return si.field(v, position[i])
+		}
+		return reflect.Value{}
+	}
+}
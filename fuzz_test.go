@@ -0,0 +1,264 @@
+// Golang support for LLSN - Allyst's data interchange format.
+// LLSN specification http://allyst.org/opensource/llsn/
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// copyright (C) 2015 Allyst Inc. http://allyst.com
+// author Taras Halturin <halturin@allyst.com>
+
+package llsn_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	llsn "github.com/allyst/go-llsn"
+)
+
+// Run the fuzzers one by one:
+//
+//	go test -run XXX -fuzz FuzzDecode$ -fuzztime 1m
+//
+// The seed corpora are checked by 'go test' as the regular tests
+
+// ExampleFuzz is ExampleMain with no files (the decoded file can't be encoded
+// back by name) and with the types of newer versions
+type ExampleFuzz struct {
+	Field1  int64
+	Field2  *int64
+	Field3  *uint64
+	Field4  [3]bool
+	Field5  float64
+	Field6  string
+	Field7  time.Time
+	Field8  *time.Time
+	Field9  ExampleStruct
+	Field10 [5]ExampleStruct
+	Field11 []ExampleStruct
+	Field12 [4]*ExampleStruct
+	Field13 [][]*ExampleStruct
+	Field14 llsn.Blob
+	Field17 []int64
+	Field18 []uint64
+	Field19 [][]*uint32
+	Field20 *big.Int
+	Field21 *big.Float
+	Field22 time.Duration
+	Field23 float32
+}
+
+func exampleFuzz() ExampleFuzz {
+	m := exampleMainValue
+	x, _ := new(big.Int).SetString("-123456789012345678901234567890", 10)
+
+	return ExampleFuzz{m.Field1, m.Field2, m.Field3, m.Field4, m.Field5, m.Field6,
+		m.Field7, m.Field8, m.Field9, m.Field10, m.Field11, m.Field12, m.Field13,
+		m.Field14, m.Field17, m.Field18, m.Field19, x, big.NewFloat(-2.5),
+		time.Minute, 1.5}
+}
+
+// fuzzSeeds returns the packets of the example values encoded with the
+// different options
+func fuzzSeeds() [][]byte {
+	seeds := [][]byte{append([]byte{}, exampleMainValueEncoded...)}
+
+	V := exampleFuzz()
+	M := exampleMessage()
+	M.Attachment = nil
+
+	options := []struct {
+		name  string
+		value interface{}
+		reset interface{}
+	}{
+		{"threshold", 0, 0},
+		{"threshold", 8, 0},
+		{"date", llsn.DATE_ZONE, llsn.DATE_COMPACT},
+		{"index", true, false},
+		{"checksum", true, false},
+		{"compress", llsn.COMPRESS_DEFLATE, llsn.COMPRESS_NONE},
+		{"version", llsn.VERSION2, 0},
+	}
+
+	for _, o := range options {
+		llsn.SetOption(o.name, o.value)
+		seeds = append(seeds, llsn.Encode(&V).Bytes(), llsn.Encode(&M).Bytes())
+		llsn.SetOption(o.name, o.reset)
+	}
+
+	return seeds
+}
+
+// fuzzDir sets the directory of decoded files. the files are removed by
+// cleanFuzzDir after every input
+func fuzzDir(f *testing.F) string {
+	d := f.TempDir() + "/"
+	llsn.SetOption("dir", d)
+	f.Cleanup(func() { llsn.SetOption("dir", llsn.DECODE_FOLDER) })
+	return d
+}
+
+func cleanFuzzDir(d string) {
+	names, _ := filepath.Glob(d + "llsndecode_*")
+	for _, name := range names {
+		os.Remove(name)
+	}
+}
+
+// watchdog crashes the fuzzing process if the input isn't processed in time
+// (the hanging input is reported as the crasher then). call the returned
+// function when it's done
+func watchdog(data []byte) func() {
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			panic(fmt.Sprintf("input %q is processed too long", data))
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, seed := range fuzzSeeds() {
+		f.Add(seed)
+	}
+
+	d := fuzzDir(f)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		defer watchdog(data)()
+		defer cleanFuzzDir(d)
+
+		var E ExampleMain
+		var F ExampleFuzz
+		var V llsn.Value
+
+		llsn.Decode(append([]byte{}, data...), &E)
+		llsn.Decode(append([]byte{}, data...), &F)
+		llsn.Decode(append([]byte{}, data...), &V)
+		llsn.DecodeFields(append([]byte{}, data...), &E, "Field13[*]", "Field6")
+		llsn.Query(append([]byte{}, data...), "12[1].1")
+
+		chn := make(chan []byte, len(data)/16+1)
+		for k := 0; k < len(data); k += 16 {
+			chn <- data[k:min(k+16, len(data))]
+		}
+		close(chn)
+		llsn.Decode(chn, &F)
+
+		if r, err := llsn.NewReader(bytes.NewReader(data), int64(len(data))); err == nil {
+			for i := 0; i < r.NumField() && i < 32; i++ {
+				r.DecodeField(i, &V)
+			}
+		}
+	})
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	for _, seed := range fuzzSeeds() {
+		f.Add(seed)
+	}
+
+	d := fuzzDir(f)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		defer watchdog(data)()
+		defer cleanFuzzDir(d)
+
+		var E1, E2 ExampleFuzz
+
+		if llsn.Decode(append([]byte{}, data...), &E1) != nil {
+			return
+		}
+
+		b1, err := llsn.Marshal(&E1)
+		if err != nil {
+			// the decoded value can be out of the range of encoder (e.g.
+			// the date of compact form)
+			return
+		}
+
+		if err := llsn.Decode(append([]byte{}, b1...), &E2); err != nil {
+			t.Fatalf("encoded value isn't decoded: %v", err)
+		}
+
+		b2, err := llsn.Marshal(&E2)
+		if err != nil || !bytes.Equal(b1, b2) {
+			t.Fatalf("%v != %v (%v)", b1, b2, err)
+		}
+	})
+}
+
+func FuzzDecodeNumber(f *testing.F) {
+	for _, n := range signed_numbers {
+		f.Add(llsn.EncodeNumber(n))
+	}
+	for _, n := range unsigned_numbers {
+		f.Add(llsn.EncodeUNumber(n))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// the longest number is 9 bytes
+		data = append(data, make([]byte, 9)...)
+
+		n := llsn.DecodeNumber(data)
+		if n1 := llsn.DecodeNumber(llsn.EncodeNumber(n)); n1 != n {
+			t.Fatalf("%d != %d", n1, n)
+		}
+
+		u := llsn.DecodeUNumber(data)
+		if u1 := llsn.DecodeUNumber(llsn.EncodeUNumber(u)); u1 != u {
+			t.Fatalf("%d != %d", u1, u)
+		}
+	})
+}
+
+func FuzzDecodeDate(f *testing.F) {
+	now := time.Now()
+	f.Add(llsn.EncodeDate(&exampleMainValue.Field7))
+	f.Add(llsn.EncodeDate(&now))
+	f.Add(llsn.EncodeDateNano(&now, true))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		data = append(data, make([]byte, 8)...)
+
+		date := llsn.DecodeDate(data)
+
+		// the date is normalized by time.Date, so the fields out of range
+		// give the date which may not be representable
+		_, offset := date.Zone()
+		if date.Year() < -32768 || date.Year() > 32767 || offset/3600 < -32 || offset/3600 > 31 {
+			return
+		}
+
+		date1 := llsn.DecodeDate(llsn.EncodeDate(date))
+		if !date1.Equal(*date) {
+			t.Fatalf("%v != %v", date1, date)
+		}
+	})
+}
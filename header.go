@@ -0,0 +1,258 @@
+// Golang support for LLSN - Allyst's data interchange format.
+// LLSN specification http://allyst.org/opensource/llsn/
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// copyright (C) 2015 Allyst Inc. http://allyst.com
+// author Taras Halturin <halturin@allyst.com>
+
+package llsn
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Header of packet:
+//
+// 2B   : version (4 bits), threshold (12 bits)
+//
+// version 2 (any feature is used):
+//
+// 1B   : flags. flag_compressed | flag_checksum | flag_digest | flag_lossless |
+//        flag_ext | flag_structid | flag_stream | flag_index
+// 1B   : compressor ID (flag_compressed)
+//
+// The encoder writes the header of version 1 unless the packet has the
+// features, so the old peers decode the plain packets. The type codes the
+// version 1 has no (TYPE_NDATE ... TYPE_STREAM) are the features as well:
+// their flags are set by the types of encoded value (see typeFlags). Decoder
+// accepts both versions and rejects the unknown flags (they may change the
+// layout of packet). "version" option pins the version of header: the packet
+// with features can't be encoded with version 1 then, version 2 is written
+// even for the plain packets.
+
+// feature flags of the header of version 2
+const (
+	FEATURE_COMPRESS = flag_compressed
+	FEATURE_CHECKSUM = flag_checksum
+	FEATURE_DIGEST   = flag_digest
+	FEATURE_LOSSLESS = flag_lossless // TYPE_NDATE, TYPE_BIGNUMBER, TYPE_BIGFLOAT
+	FEATURE_EXT      = flag_ext      // TYPE_EXT, TYPE_INTERFACE
+	FEATURE_STRUCTID = flag_structid
+	FEATURE_STREAM   = flag_stream
+	FEATURE_INDEX    = flag_index
+
+	flags_known = flag_compressed | flag_checksum | flag_digest | flag_index | flags_types
+)
+
+// Features describes the packets the decoder accepts. Peers exchange them
+// to choose the options of encoding (it's the regular struct, so it can be
+// encoded with LLSN as well)
+type Features struct {
+	Versions    []uint8 // versions of header
+	Flags       uint8   // FEATURE_* of the header of version 2
+	Compressors []uint8 // IDs of the registered compressors
+	LastType    uint8   // the last type code (TYPE_STREAM)
+}
+
+// Supported returns the features of this decoder
+func Supported() Features {
+	f := Features{
+		Versions: []uint8{VERSION, VERSION2},
+		Flags:    flags_known,
+		LastType: type_last,
+	}
+
+	compressors.RLock()
+	for id := range compressors.ids {
+		f.Compressors = append(f.Compressors, id)
+	}
+	compressors.RUnlock()
+
+	sort.Slice(f.Compressors, func(i, j int) bool {
+		return f.Compressors[i] < f.Compressors[j]
+	})
+
+	return f
+}
+
+// Accepts returns true if the peer with features 'f' decodes the packets
+// of header 'version' with the feature 'flags' and 'compressor' (the
+// compressor is ignored with no FEATURE_COMPRESS)
+func (f Features) Accepts(version, flags, compressor uint8) bool {
+	if !hasByte(f.Versions, version) {
+		return false
+	}
+
+	if version == VERSION {
+		return flags == 0
+	}
+
+	if flags&^f.Flags != 0 {
+		return false
+	}
+
+	return flags&FEATURE_COMPRESS == 0 || hasByte(f.Compressors, compressor)
+}
+
+func hasByte(list []uint8, b uint8) bool {
+	for _, x := range list {
+		if x == b {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeHeader returns the header of packet with the 'pinned' version (0 -
+// the version is chosen by the features). panics if the features can't be
+// encoded with the pinned version
+func encodeHeader(threshold uint16, flags byte, compressor uint8, pinned uint8) []byte {
+	v := uint8(VERSION)
+	if flags != 0 || pinned == VERSION2 {
+		v = VERSION2
+	}
+
+	if pinned == VERSION && v != VERSION {
+		panic("the header of version 2 is required for " + featureNames(flags))
+	}
+
+	header := []byte{byte(((threshold >> 8) & 0xf) | uint16(v)<<4), byte(threshold)}
+	if v == VERSION {
+		return header
+	}
+
+	header = append(header, flags)
+	if flags&flag_compressed > 0 {
+		header = append(header, compressor)
+	}
+
+	return header
+}
+
+// featureNames returns the names of feature 'flags' for the messages
+func featureNames(flags byte) string {
+	var names []string
+
+	for _, f := range []struct {
+		flag byte
+		name string
+	}{
+		{flag_compressed, "compression"},
+		{flag_checksum, "checksum"},
+		{flag_digest, "digest"},
+		{flag_lossless, "lossless dates and big numbers"},
+		{flag_ext, "extensions and interfaces"},
+		{flag_structid, "field IDs"},
+		{flag_stream, "streams"},
+		{flag_index, "index"},
+	} {
+		if flags&f.flag > 0 {
+			names = append(names, f.name)
+		}
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// flag_date marks the dates for typeFlags. they are flag_lossless unless they
+// are compact
+const flag_date = 0x100
+
+// the flags of types. flattened structs have the other fields, the built-in
+// extensions are not used by the legacy encoding
+type typeFlagsKey struct {
+	t       reflect.Type
+	flatten bool
+	legacy  bool
+}
+
+var typesFlags sync.Map
+
+// typeFlags returns the flags of the type codes of version 2 the values of
+// type 't' are encoded with. the content of interfaces is unknown, so they
+// have all the flags
+func typeFlags(t reflect.Type, opts encodeOpts) byte {
+	key := typeFlagsKey{t, flatten, opts.legacy}
+
+	var f uint16
+	if v, ok := typesFlags.Load(key); ok {
+		f = v.(uint16)
+	} else {
+		f = walkTypeFlags(t, opts.legacy, map[reflect.Type]bool{})
+		typesFlags.Store(key, f)
+	}
+
+	if f&flag_date > 0 && (opts.canonical || datemode != DATE_COMPACT) {
+		f |= flag_lossless
+	}
+
+	return byte(f)
+}
+
+func walkTypeFlags(t reflect.Type, legacy bool, seen map[reflect.Type]bool) uint16 {
+	if seen[t] {
+		return 0
+	}
+	seen[t] = true
+
+	if encodingExt(t, legacy) != nil {
+		return flag_ext
+	}
+
+	switch t {
+	case dateType:
+		return flag_date
+	case bignumberType, bigfloatType:
+		return flag_lossless
+	case blobType, fileType:
+		return 0
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Array, reflect.Slice:
+		// nil pointers of the registered types are TYPE_EXT as well
+		return walkTypeFlags(t.Elem(), legacy, seen)
+
+	case reflect.Interface:
+		return flag_date | flags_types
+
+	case reflect.Struct:
+		if t.Implements(streamerType) {
+			return flag_stream |
+				walkTypeFlags(reflect.Zero(t).Interface().(streamer).elemType(), legacy, seen)
+		}
+
+		si := getStructInfo(t)
+
+		var f uint16
+		if si.ids != nil {
+			f = flag_structid
+		}
+		for _, field := range si.fields {
+			f |= walkTypeFlags(field.t, legacy, seen)
+		}
+		return f
+	}
+
+	return 0
+}
@@ -0,0 +1,260 @@
+// Golang support for LLSN - Allyst's data interchange format.
+// LLSN specification http://allyst.org/opensource/llsn/
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// copyright (C) 2015 Allyst Inc. http://allyst.com
+// author Taras Halturin <halturin@allyst.com>
+
+package llsn
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+)
+
+// Index is the optional trailer of packet (see "index" option) for the
+// random access to the top level fields and tailed data:
+//
+// 1..9B  : number of fields (UNUMBER)
+// n*1..9B: offsets of fields (UNUMBER)
+// n*1..9B: number of the first tail element of field (UNUMBER)
+// 1..9B  : number of tail elements (UNUMBER)
+// m*1..9B: offsets of tail elements (UNUMBER)
+// 8B     : offset of index (big-endian)
+// 4B     : "LLSX"
+//
+// offsets are counted from the beginning of packet. The header has
+// FEATURE_INDEX, decoder skips the index after the tail (and checksum).
+// Reader doesn't verify the checksum.
+
+const index_magic = "LLSX"
+
+// encodeIndexed encodes 'n' top level fields one by one counting the offsets
+// and returns the index. 'offset' is the length of header
+func encodeIndexed(w io.Writer, value reflect.Value, n uint64,
+	index func(int) reflect.Value, tail_first *tailElement, offset uint64, opts encodeOpts) []byte {
+
+	var tail *tailElement = tail_first
+	var ntail uint64
+
+	fields := make([]uint64, n)
+	firsts := make([]uint64, n)
+
+	offset += uint64(len(EncodeUNumber(n)))
+
+	for k := uint64(0); k < n; k++ {
+		field := index(int(k))
+
+		fields[k] = offset
+		firsts[k] = ntail
+
+		cw := &countWriter{w: w}
+		encode_loop(cw, value, 1, func(int) reflect.Value { return field }, tail, opts)
+		offset += cw.n
+
+		for ; tail.next != nil; tail = tail.next {
+			ntail++
+		}
+	}
+
+	tails := make([]uint64, 0, ntail)
+	for tail = tail_first.next; tail != nil; tail = tail.next {
+		tails = append(tails, offset)
+		offset += tail.length
+
+		if _, ok := tail.value.Interface().(File); ok && opts.digests {
+			offset += sha256.Size
+		}
+	}
+
+	encodeTail(w, tail_first, opts)
+
+	if checksums {
+		// the checksum precedes the index
+		offset += 4
+	}
+
+	bin := EncodeUNumber(n)
+	for _, o := range fields {
+		bin = append(bin, EncodeUNumber(o)...)
+	}
+	for _, t := range firsts {
+		bin = append(bin, EncodeUNumber(t)...)
+	}
+	bin = append(bin, EncodeUNumber(ntail)...)
+	for _, o := range tails {
+		bin = append(bin, EncodeUNumber(o)...)
+	}
+
+	bin = binary.BigEndian.AppendUint64(bin, offset)
+	return append(bin, index_magic...)
+}
+
+// Reader reads the top level fields of the packet with index by random
+// access. Only the requested field and its tailed data are read.
+type Reader struct {
+	r         io.ReaderAt
+	threshold uint16
+	n         uint64
+	fields    []uint64 // offsets of fields
+	firsts    []uint64 // number of the first tail element of field
+	tails     []uint64 // offsets of tail elements
+	digests   bool     // file data are followed by the digest
+}
+
+// NewReader reads the index of the packet of 'size' bytes
+func NewReader(r io.ReaderAt, size int64) (reader *Reader, err error) {
+	var buffer decodeBuffer
+
+	defer recoverError(&err)
+
+	footer := make([]byte, 12)
+	if size < int64(len(footer)) {
+		return nil, errors.New("Packet has no index")
+	}
+	if _, err := r.ReadAt(footer, size-12); err != nil {
+		return nil, err
+	}
+
+	offset := binary.BigEndian.Uint64(footer)
+	if string(footer[8:]) != index_magic || offset >= uint64(size-12) {
+		return nil, errors.New("Packet has no index")
+	}
+
+	bin := make([]byte, uint64(size-12)-offset)
+	if _, err := r.ReadAt(bin, int64(offset)); err != nil {
+		return nil, err
+	}
+
+	reader = &Reader{r: r}
+	buffer.init_buffer(bin)
+
+	reader.n = decodeUNumber(&buffer)
+	reader.fields = decodeOffsets(&buffer, reader.n, offset)
+	reader.firsts = decodeOffsets(&buffer, reader.n, 0)
+	ntail := decodeUNumber(&buffer)
+	reader.tails = decodeOffsets(&buffer, ntail, offset)
+
+	for _, t := range reader.firsts {
+		if t > ntail {
+			panic("Invalid index")
+		}
+	}
+
+	// header
+	buffer.init_reader_at(r, 0)
+	if decodeHeader(&buffer) != reader.n {
+		panic("Invalid index")
+	}
+	reader.threshold = threshold
+	reader.digests = buffer.digests
+
+	return reader, nil
+}
+
+// decodeOffsets reads 'n' numbers of index. the numbers are less then 'limit'
+// if it's not 0
+func decodeOffsets(buffer *decodeBuffer, n uint64, limit uint64) []uint64 {
+	if n > uint64(len(buffer.buffer)) {
+		panic("Invalid index")
+	}
+
+	offsets := make([]uint64, n)
+	for i := range offsets {
+		offsets[i] = decodeUNumber(buffer)
+		if limit > 0 && offsets[i] >= limit {
+			panic("Invalid index")
+		}
+	}
+
+	return offsets
+}
+
+// NumField returns the number of top level fields
+func (r *Reader) NumField() int {
+	return int(r.n)
+}
+
+// DecodeField decodes the i'th field into 'v' (pointer to the variable of
+// field type)
+func (r *Reader) DecodeField(i int, v interface{}) (err error) {
+	value := reflect.ValueOf(v)
+
+	defer recoverError(&err)
+
+	if value.Kind() != reflect.Ptr || value.IsNil() {
+		return errors.New("Incorrect type of the destination (expect pointer)")
+	}
+
+	if i < 0 || uint64(i) >= r.n {
+		oops(ERR_NOT_FOUND, "field out of range")
+	}
+
+	r.decode(i, value.Elem(), nil)
+	return nil
+}
+
+// Query returns the value at 'path' (see Query)
+func (r *Reader) Query(path string, schema ...interface{}) (value Value, err error) {
+	var buffer decodeBuffer
+	var root Value
+
+	defer recoverError(&err)
+
+	q, err := newQuery(path, schema)
+	if err != nil {
+		return value, err
+	}
+
+	if r.n > 0 {
+		buffer.init_reader_at(r.r, int64(r.fields[0]))
+		q.wrap(r.n, buffer.look(1)[0])
+	}
+
+	k := q.field()
+	if k < 0 || uint64(k) >= r.n {
+		oops(ERR_NOT_FOUND, path)
+	}
+
+	root.Items = make([]Value, 1)
+	r.decode(k, reflect.ValueOf(&root.Items[0]).Elem(), q.mask.items[k].root())
+
+	return q.result(root), nil
+}
+
+// decode reads the i'th field and its tailed data
+func (r *Reader) decode(i int, value reflect.Value, mask maskFunc) {
+	var buffer decodeBuffer
+	var tail *tailElement = &tailElement{}
+
+	threshold = r.threshold
+
+	buffer.init_reader_at(r.r, int64(r.fields[i]))
+	buffer.digests = r.digests
+	decode_loop(&buffer, 1, func(int) reflect.Value { return value }, tail, mask)
+
+	if selectedTail(tail).next != nil {
+		buffer.init_reader_at(r.r, int64(r.tails[r.firsts[i]]))
+		decodeTail(&buffer, tail)
+	}
+}
@@ -0,0 +1,169 @@
+// Golang support for LLSN - Allyst's data interchange format.
+// LLSN specification http://allyst.org/opensource/llsn/
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// copyright (C) 2015 Allyst Inc. http://allyst.com
+// author Taras Halturin <halturin@allyst.com>
+
+package llsn
+
+import (
+	"io"
+	"reflect"
+	"sync"
+)
+
+// Values of the interface fields are encoded with the name of their concrete
+// type. Encoded value of interface:
+//
+// 1B   : type_interface (type_interface_null)
+// 1..n : registered name of the concrete type (UNUMBER length + string)
+// 1..n : encoded value (UNUMBER length + data)
+//
+// type code is written once, but the name and value - every time, because
+// the concrete type could be different for every item. value is encoded with
+// its own types tree and has no tailed data.
+
+var registry = struct {
+	sync.RWMutex
+	names map[string]reflect.Type
+	types map[reflect.Type]string
+}{
+	names: make(map[string]reflect.Type),
+	types: make(map[reflect.Type]string),
+}
+
+// Register records the concrete type of 'v' under the 'name'. Encoder writes
+// this name before the values stored in the interface fields, so the decoder
+// is able to instantiate the same type. Like gob.Register it panics if
+// the name or type is already registered with the different one.
+func Register(name string, v interface{}) {
+	t := reflect.TypeOf(v)
+
+	if name == "" {
+		panic("attempt to register empty name")
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	if rt, exist := registry.names[name]; exist && rt != t {
+		panic("name " + name + " is already registered for type " + rt.String())
+	}
+
+	if rn, exist := registry.types[t]; exist && rn != name {
+		panic("type " + t.String() + " is already registered as " + rn)
+	}
+
+	registry.names[name] = t
+	registry.types[t] = name
+}
+
+func lookupName(name string) reflect.Type {
+	registry.RLock()
+	defer registry.RUnlock()
+	return registry.names[name]
+}
+
+func lookupType(t reflect.Type) string {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	if name, ok := registry.types[t]; ok {
+		return name
+	}
+
+	// pointer to the registered type
+	if t.Kind() == reflect.Ptr {
+		return registry.types[t.Elem()]
+	}
+
+	return ""
+}
+
+func encodeInterface(v reflect.Value, opts encodeOpts) []byte {
+	name := lookupType(v.Type())
+	if name == "" {
+		panic("type " + v.Type().String() + " is not registered (see llsn.Register)")
+	}
+
+	payload := encodeNested(v, opts)
+
+	bin := EncodeUNumber(uint64(len(name)))
+	bin = append(bin, name...)
+	bin = append(bin, EncodeUNumber(uint64(len(payload)))...)
+	return append(bin, payload...)
+}
+
+// encodeNested encodes the single value with its own types tree and
+// disabled tail encoding. file digests are not written
+func encodeNested(v reflect.Value, opts encodeOpts) []byte {
+	return encodeBytes(func(w io.Writer) {
+		encode_loop(w, v, 1, func(int) reflect.Value { return v }, nil,
+			encodeOpts{canonical: opts.canonical, sizing: opts.sizing,
+				legacy: opts.legacy, v1: opts.v1})
+	})
+}
+
+// decodeInterface instantiates the registered type and decodes the value into
+// it. values of unregistered types are decoded into the generic Value if
+// the field is 'interface{}'
+func decodeInterface(buffer *decodeBuffer, field reflect.Value) {
+	var b decodeBuffer
+	var value reflect.Value
+
+	bname := buffer.read(decodeUNumber(buffer))
+	payload := buffer.read(decodeUNumber(buffer))
+
+	if !field.IsValid() {
+		return
+	}
+
+	name := string(bname)
+
+	t := lookupName(name)
+
+	switch {
+	case t != nil:
+		value = reflect.New(t)
+
+	case field.Type().NumMethod() == 0:
+		value = reflect.New(valueType)
+
+	default:
+		oops(ERR_UNREGISTERED_TYPE, name)
+	}
+
+	b.init_buffer(payload)
+	b.v1 = buffer.v1
+	decode_loop(&b, 1, func(int) reflect.Value { return value.Elem() }, nil, nil)
+
+	if t == nil {
+		value.Elem().FieldByName("Name").SetString(name)
+	}
+
+	// type could be registered as a value but implements the interface
+	// of field as a pointer only
+	if value.Elem().Type().AssignableTo(field.Type()) {
+		field.Set(value.Elem())
+	} else {
+		field.Set(value)
+	}
+}
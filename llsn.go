@@ -29,24 +29,37 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
-	"sync"
 )
 
 // global variables
 var threshold uint16
+var chunk int
 var dir string
 var version uint8
+var datemode int
+var strict bool
+var flatten bool
+var indexed bool
+var compression uint8
+var checksums bool
+var digests bool
+var canonical bool
 
 ////////////////////////////////////////////////////////////////////////////////
 // ENCODE routines
 ////////////////////////////////////////////////////////////////////////////////
 
-// Encode method allows calling
+// Encode method allows calling. The value is the struct (or pointer to it),
+// array or scalar value
 //
 // Encode(value)
 // Encode(value, threshold)
 //
-// return nil in this case. all encoded data writes to the channel
+// the buffer is taken from the pool. it can be given back by Release
+// once the data are consumed
+//
+// return nil in this case. all encoded data writes to the channel by chunks
+// of "chunk" option size
 // Encode(value, channel)
 // Encode(value, channel, threshold)
 func Encode(v interface{}, a ...interface{}) *bytes.Buffer {
@@ -54,19 +67,14 @@ func Encode(v interface{}, a ...interface{}) *bytes.Buffer {
 	var args []interface{} = a
 	var channel chan []byte
 	var buffer *bytes.Buffer
-	var wg sync.WaitGroup
 
 	switch len(args) {
 	case 0:
-		channel = make(chan []byte)
-		buffer = new(bytes.Buffer)
 
 	case 1:
 		switch reflect.ValueOf(args[0]).Kind() {
 		case reflect.Int:
 			threshold = uint16(args[0].(int))
-			channel = make(chan []byte)
-			buffer = new(bytes.Buffer)
 
 		case reflect.Chan:
 			channel = args[0].(chan []byte)
@@ -83,72 +91,120 @@ func Encode(v interface{}, a ...interface{}) *bytes.Buffer {
 		panic("wrong arguments")
 	}
 
-	if value.Kind() != reflect.Ptr || value.Elem().Kind() != reflect.Struct {
-		panic("Incorrect type of the source (expect '*struct')")
+	if channel != nil {
+		defer close(channel)
+	}
+
+	if !value.IsValid() || (value.Kind() == reflect.Ptr && value.IsNil()) {
+		panic("Incorrect source (nil)")
 	}
-	value = value.Elem()
 
-	// create internal channel handler
-	if buffer != nil {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for {
-				b, ok := <-channel
-				if ok {
-					buffer.Write(b)
-				} else {
-					break
-				}
-			}
-		}()
+	// pointer to pointer is encoded as the nullable value
+	if value.Kind() == reflect.Ptr {
+		value = value.Elem()
+	}
 
+	if channel == nil {
+		buffer = getBuffer()
+		encode_ext(value, buffer, threshold, canonical)
+		return buffer
 	}
 
 	// encode it
-	encode_ext(value, channel, threshold)
+	w := &chunkWriter{channel: channel, size: chunk}
+	encode_ext(value, w, threshold, canonical)
+	w.flush()
+
+	return nil
+}
+
+// Size returns the length of packet Encode(v) gives with the current
+// options, the tailed data and the files included. The data are counted, not
+// kept, but every byte is formatted as Encode does, and the compressor runs
+// on the whole payload. The files are not read unless the packet is
+// compressed, so the size is exact as long as they don't change before
+// encoding. The values with Stream can't be counted (the elements are taken
+// from the iterator), Size returns the error for them
+func Size(v interface{}) (size int64, err error) {
+	var value reflect.Value = reflect.ValueOf(v)
+	var w sizeWriter
+
+	if !value.IsValid() || (value.Kind() == reflect.Ptr && value.IsNil()) {
+		return 0, errors.New("Incorrect source (nil)")
+	}
 
-	// we should wait channel's routines in case of using internal handler
-	if buffer != nil {
-		wg.Wait()
+	if value.Kind() == reflect.Ptr {
+		value = value.Elem()
 	}
 
-	return buffer
+	defer recoverEncode(&err)
+
+	encode_ext(value, &w, threshold, canonical)
+	return int64(w.n), nil
 }
 
+// Decode decodes the packet into the 'destination' pointer of the encoded
+// value kind (struct, array or scalar). The packet of other kind is the error.
+// Value takes any packet, the fields of struct packet are its Items
 func Decode(source interface{}, destination interface{}) (err error) {
+	return decode(source, destination, nil)
+}
+
+// DecodeFields decodes only the fields selected by the 'paths'
+// ("Header.ID", "Items[*].Name", "Items[2]"). the rest of data is skipped
+func DecodeFields(source interface{}, destination interface{}, paths ...string) error {
+	mask, err := newFieldMask(paths)
+	if err != nil {
+		return err
+	}
+
+	return decode(source, destination, mask)
+}
+
+func decode(source interface{}, destination interface{}, mask *fieldMask) (err error) {
 	var value reflect.Value = reflect.ValueOf(destination)
 	var buffer decodeBuffer
 
-	defer func() {
-		if r := recover(); r != nil {
-			err = errors.New(fmt.Sprintf("Malformed data. (%s)", r))
-		}
-	}()
+	defer recoverError(&err)
+
+	if value.Kind() != reflect.Ptr || value.IsNil() {
+		return errors.New("Incorrect type of the destination (expect pointer)")
+	}
 
-	if value.Kind() != reflect.Ptr || value.Elem().Kind() != reflect.Struct {
+	if mask != nil && !isRecord(value.Elem().Type()) {
 		return errors.New("Incorrect type of the destination (expect '*struct')")
 	}
 
 	value = value.Elem()
 
-	switch v := source.(type) {
-	case []byte:
-		buffer.init_buffer(v)
-
-	case chan []byte:
-		buffer.init_chan(v)
-
-	default:
-		return errors.New("Incorrect type of the source (expect 'chan []byte' or '[]byte'")
+	if err := buffer.init_source(source); err != nil {
+		return err
 	}
 
-	decode_ext(&buffer, &value)
+	decode_ext(&buffer, &value, mask)
 	return err
 }
 
+// recoverError turns the panic of decoder into the error
+func recoverError(err *error) {
+	if r := recover(); r != nil {
+		switch e := r.(type) {
+		case *ErrorLLSN:
+			*err = e
+			return
+		case *callbackError:
+			*err = e.err
+			return
+		case *callbackPanic:
+			panic(e.value)
+		}
+		*err = errors.New(fmt.Sprintf("Malformed data. (%s)", r))
+	}
+}
+
 func init() {
 	threshold = DEFAULT_THRESHOLD
+	chunk = DEFAULT_CHUNK
 	dir = DECODE_FOLDER
 }
 
@@ -156,8 +212,38 @@ func SetOption(name string, v interface{}) {
 	switch name {
 	case "threshold":
 		threshold = uint16(v.(int))
+	case "chunk":
+		chunk = v.(int)
 	case "dir":
 		dir = v.(string)
+	case "date":
+		switch v.(int) {
+		case DATE_COMPACT, DATE_LOSSLESS, DATE_ZONE:
+			datemode = v.(int)
+		default:
+			panic("unsupported date mode")
+		}
+	case "strict":
+		strict = v.(bool)
+	case "flatten":
+		flatten = v.(bool)
+	case "index":
+		indexed = v.(bool)
+	case "compress":
+		compression = uint8(v.(int))
+	case "checksum":
+		checksums = v.(bool)
+	case "digest":
+		digests = v.(bool)
+	case "canonical":
+		canonical = v.(bool)
+	case "version":
+		switch v.(int) {
+		case 0, VERSION, VERSION2:
+			version = uint8(v.(int))
+		default:
+			panic("unsupported version")
+		}
 
 	default:
 		panic("unknown option")
@@ -26,11 +26,18 @@ package llsn_test
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"errors"
 	"fmt"
 	llsn "github.com/allyst/go-llsn"
+	"io"
+	"math"
+	"math/big"
 	"math/rand"
+	"net"
+	"net/url"
 	"os"
+	"runtime"
 	"testing"
 	"time"
 )
@@ -168,22 +175,1871 @@ func TestLLSN_1M_random_DATE(t *testing.T) {
 	fmt.Printf("TestLLSN_1M_random_DATE: PASSED\n")
 }
 
+func TestLLSN_DATE_offsets(t *testing.T) {
+	zones := []int{0, 3600, -3600, 5*3600 + 30*60, -(3*3600 + 30*60), 14 * 3600, -12 * 3600}
+
+	for _, z := range zones {
+		for _, y := range []int{2015, 1, -1, -2000, 32767, -32767} {
+			d := time.Date(y, time.March, 7, 23, 59, 58, 123000000, time.FixedZone("", z))
+			d1 := llsn.DecodeDate(llsn.EncodeDate(&d))
+			_, z1 := d1.Zone()
+
+			if !d.Equal(*d1) || z != z1 {
+				t.Fatalf("date source: %s, date dest: %s", d, d1)
+			}
+		}
+	}
+
+	fmt.Printf("TestLLSN_DATE_offsets: PASSED\n")
+}
+
+func TestLLSN_1M_random_DATE_nano(t *testing.T) {
+
+	for kk := 1; kk < 1000000; kk++ {
+		d := time.Unix(rand.Int63n(1<<uint(rand.Int63n(45)))-(1<<44), rand.Int63n(1000000000))
+		d = d.In(time.FixedZone("", int(rand.Int63n(26*3600))-13*3600))
+		d1 := llsn.DecodeDateNano(llsn.EncodeDateNano(&d, false))
+		_, z := d.Zone()
+		_, z1 := d1.Zone()
+
+		if !d.Equal(*d1) || z != z1 {
+			t.Fatalf("date source: %s, date dest: %s", d, d1)
+		}
+	}
+
+	fmt.Printf("TestLLSN_1M_random_DATE_nano: PASSED\n")
+}
+
+type ExampleDates struct {
+	D1 time.Time
+	D2 *time.Time
+	D3 []time.Time
+	D4 []*time.Time
+}
+
+func TestLLSN_DATE_zone(t *testing.T) {
+	var E1 ExampleDates
+
+	loc, err := time.LoadLocation("America/St_Johns")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	d := time.Date(-44, time.March, 15, 11, 30, 0, 123456789, loc)
+	E := ExampleDates{d, nil, []time.Time{d, d.AddDate(0, 6, 0)}, []*time.Time{nil, &d}}
+
+	llsn.SetOption("date", llsn.DATE_ZONE)
+	defer llsn.SetOption("date", llsn.DATE_COMPACT)
+
+	if err := llsn.Decode(llsn.Encode(&E).Bytes(), &E1); err != nil {
+		t.Fatal(err)
+	}
+
+	if !E1.D1.Equal(d) || E1.D1.Location().String() != "America/St_Johns" ||
+		E1.D2 != nil || !E1.D3[1].Equal(E.D3[1]) || E1.D4[0] != nil || !E1.D4[1].Equal(d) {
+		t.Fatalf("%v != %v", E1, E)
+	}
+
+	if E1.D3[1].Format("-07:00") != E.D3[1].Format("-07:00") {
+		t.Fatalf("%s != %s", E1.D3[1], E.D3[1])
+	}
+
+	// unknown mode is rejected
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatalf("unknown date mode is accepted")
+			}
+		}()
+		llsn.SetOption("date", 3)
+	}()
+
+	fmt.Printf("TestLLSN_DATE_zone: PASSED\n")
+}
+
 func TestLLSN_1M_random_FLOAT(t *testing.T) {
 
-	// for kk := 1; kk < 1000000; kk++ {
-	// 	f := rand.Float64()
-	// 	fb := llsn.EncodeFloat(f)
-	// 	f1 := llsn.DecodeFloat(fb)
-	// 	if f != f1 {
-	// 		t.Fatal(fmt.Sprintf("%f != %f", f, f1))
-	// 	}
-	// }
-
-	// BUG!
-	// 0.9430547821300547
-	// fb := []byte{16, 254, 33, 129, 8, 132, 237, 11, 66}
-	// f1, _ := llsn.DecodeFloat(fb)
-	fmt.Printf("TestLLSN_1M_random_FLOAT: PASSED\n")
+	for kk := 1; kk < 1000000; kk++ {
+		f := rand.Float64()
+		fb := llsn.EncodeFloat(f)
+		f1 := llsn.DecodeFloat(fb)
+		if f != f1 {
+			t.Fatalf("%v != %v", f, f1)
+		}
+	}
+
+	fmt.Printf("TestLLSN_1M_random_FLOAT: PASSED\n")
+}
+
+func TestLLSN_1M_random_bits_FLOAT(t *testing.T) {
+	rand.Seed(time.Now().UTC().UnixNano())
+
+	for kk := 1; kk < 1000000; kk++ {
+		f := math.Float64frombits(rand.Uint64())
+		if math.IsNaN(f) {
+			continue
+		}
+
+		f1 := llsn.DecodeFloat(llsn.EncodeFloat(f))
+		if math.Float64bits(f) != math.Float64bits(f1) {
+			t.Fatalf("%v (%x) != %v (%x)", f, math.Float64bits(f), f1, math.Float64bits(f1))
+		}
+	}
+
+	for kk := 1; kk < 1000000; kk++ {
+		f := math.Float32frombits(rand.Uint32())
+		if f != f {
+			continue
+		}
+
+		f1 := llsn.DecodeFloat32(llsn.EncodeFloat32(f))
+		if math.Float32bits(f) != math.Float32bits(f1) {
+			t.Fatalf("%v (%x) != %v (%x)", f, math.Float32bits(f), f1, math.Float32bits(f1))
+		}
+	}
+
+	fmt.Printf("TestLLSN_1M_random_bits_FLOAT: PASSED\n")
+}
+
+func TestLLSN_FLOAT_edge_cases(t *testing.T) {
+	values := []float64{0, math.Copysign(0, -1), 1, -1, 0.1, 1e-300, -1e-300,
+		1e300, 123456789e100, math.MaxFloat64, -math.MaxFloat64,
+		math.SmallestNonzeroFloat64, 1 << 63, 1 << 64, float64(math.MaxInt64),
+		math.Inf(1), math.Inf(-1)}
+
+	for _, f := range values {
+		f1 := llsn.DecodeFloat(llsn.EncodeFloat(f))
+		if math.Float64bits(f) != math.Float64bits(f1) {
+			t.Fatalf("%v != %v", f, f1)
+		}
+	}
+
+	if f := llsn.DecodeFloat(llsn.EncodeFloat(math.NaN())); !math.IsNaN(f) {
+		t.Fatalf("NaN != %v", f)
+	}
+
+	// float32 should be encoded with its own precision
+	if b := llsn.EncodeFloat32(0.1); len(b) != 2 {
+		t.Fatalf("float32 0.1 is encoded into %d bytes", len(b))
+	}
+
+	// compatibility with the previous encoder (1B power of 10 + NUMBER)
+	if f := llsn.DecodeFloat([]byte{1, 50}); f != 5 {
+		t.Fatalf("5 != %v", f)
+	}
+
+	fmt.Printf("TestLLSN_FLOAT_edge_cases: PASSED\n")
+}
+
+type ExampleFloats struct {
+	F1 float32
+	F2 *float32
+	F3 *float64
+	F4 []float64
+	F5 []*float32
+}
+
+func TestLLSN_FLOAT_struct(t *testing.T) {
+	var E1 ExampleFloats
+	var f2 float32 = 0.3
+	var f3 float64 = -1e-300
+
+	E := ExampleFloats{0.1, &f2, &f3, []float64{math.Inf(1), math.Copysign(0, -1), 1e300},
+		[]*float32{nil, &f2}}
+
+	// the special values need the header of version 2
+	llsn.SetOption("version", llsn.VERSION2)
+	defer llsn.SetOption("version", 0)
+
+	if err := llsn.Decode(llsn.Encode(&E).Bytes(), &E1); err != nil {
+		t.Fatal(err)
+	}
+
+	if E1.F1 != E.F1 || *E1.F2 != *E.F2 || *E1.F3 != *E.F3 ||
+		E1.F4[0] != E.F4[0] || !math.Signbit(E1.F4[1]) || E1.F4[2] != E.F4[2] ||
+		E1.F5[0] != nil || *E1.F5[1] != f2 {
+		t.Fatalf("%v != %v", E1, E)
+	}
+
+	// the header of version 1 has the unsigned scale of the old decoders
+	llsn.SetOption("version", 0)
+	if b := llsn.Encode(&struct{ F float64 }{1000}).Bytes(); b[0]>>4 != llsn.VERSION ||
+		b[4] != 0 || llsn.DecodeNumber(b[5:]) != 1000 {
+		t.Fatalf("1000 is encoded as %v", b)
+	}
+
+	for _, f := range []float64{1e20, 5e-324, math.NaN(), math.Inf(-1)} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Fatalf("%v is encoded with the header of version 1", f)
+				}
+			}()
+			llsn.Encode(&struct{ F float64 }{f})
+		}()
+	}
+
+	fmt.Printf("TestLLSN_FLOAT_struct: PASSED\n")
+}
+
+func TestLLSN_BIG(t *testing.T) {
+	ints := []string{"0", "1", "-1", "255", "-256", "340282366920938463463374607431768211455",
+		"-123456789012345678901234567890123456789012345678901234567890"}
+
+	for _, s := range ints {
+		x, _ := new(big.Int).SetString(s, 10)
+		if x1 := llsn.DecodeBigNumber(llsn.EncodeBigNumber(x)); x.Cmp(x1) != 0 {
+			t.Fatalf("%s != %s", x, x1)
+		}
+	}
+
+	floats := []*big.Float{new(big.Float), big.NewFloat(math.Copysign(0, -1)),
+		big.NewFloat(math.Inf(-1)), big.NewFloat(3.141596), big.NewFloat(-1e-300),
+		new(big.Float).SetPrec(1000).SetMode(big.AwayFromZero).Quo(big.NewFloat(1), big.NewFloat(3)),
+		new(big.Float).SetMantExp(big.NewFloat(1), 1<<20)}
+
+	for _, x := range floats {
+		x1 := llsn.DecodeBigFloat(llsn.EncodeBigFloat(x))
+		if x.Cmp(x1) != 0 || x.Prec() != x1.Prec() || x.Mode() != x1.Mode() || x.Signbit() != x1.Signbit() {
+			t.Fatalf("%s != %s", x, x1)
+		}
+	}
+
+	fmt.Printf("TestLLSN_BIG: PASSED\n")
+}
+
+type ExampleBig struct {
+	B1 *big.Int
+	B2 *big.Int
+	B3 []*big.Int
+	B4 *big.Float
+	B5 big.Int
+}
+
+func TestLLSN_BIG_struct(t *testing.T) {
+	var E1 ExampleBig
+
+	id, _ := new(big.Int).SetString("ffffffffffffffffffffffffffffff01", 16)
+	E := ExampleBig{id, nil, []*big.Int{nil, big.NewInt(-7)}, big.NewFloat(0.5), *big.NewInt(42)}
+
+	if err := llsn.Decode(llsn.Encode(&E).Bytes(), &E1); err != nil {
+		t.Fatal(err)
+	}
+
+	if E1.B1.Cmp(id) != 0 || E1.B2 != nil || E1.B3[0] != nil || E1.B3[1].Int64() != -7 ||
+		E1.B4.Cmp(E.B4) != 0 || E1.B5.Int64() != 42 {
+		t.Fatalf("%v != %v", E1, E)
+	}
+
+	fmt.Printf("TestLLSN_BIG_struct: PASSED\n")
+}
+
+type ExamplePoint struct {
+	X, Y int16
+}
+
+type ExampleExt struct {
+	E1 time.Duration
+	E2 *time.Duration
+	E3 net.IP
+	E4 []net.IP
+	E5 *url.URL
+	E6 url.URL
+	E7 llsn.UUID
+	E8 []llsn.UUID
+	E9 []ExamplePoint
+}
+
+func init() {
+	llsn.RegisterExt(100, ExamplePoint{},
+		func(v interface{}) []byte {
+			p := v.(ExamplePoint)
+			return []byte{byte(p.X >> 8), byte(p.X), byte(p.Y >> 8), byte(p.Y)}
+		},
+		func(b []byte) (interface{}, error) {
+			return ExamplePoint{int16(b[0])<<8 | int16(b[1]), int16(b[2])<<8 | int16(b[3])}, nil
+		})
+}
+
+func TestLLSN_EXT(t *testing.T) {
+	var E1 ExampleExt
+
+	u, _ := url.Parse("https://user@allyst.org:8080/opensource/llsn/?q=1#spec")
+	uuid := llsn.UUID{0x6b, 0xa7, 0xb8, 0x10, 0x9d, 0xad, 0x11, 0xd1, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8}
+	E := ExampleExt{1500 * time.Millisecond, nil, net.ParseIP("192.168.0.1"),
+		[]net.IP{nil, net.ParseIP("2001:db8::68")}, u, *u, uuid, []llsn.UUID{uuid, {}},
+		[]ExamplePoint{{1, -1}, {-300, 300}}}
+
+	if err := llsn.Decode(llsn.Encode(&E).Bytes(), &E1); err != nil {
+		t.Fatal(err)
+	}
+
+	if E1.E1 != E.E1 || E1.E2 != nil || !E1.E3.Equal(E.E3) || E1.E4[0] != nil ||
+		!E1.E4[1].Equal(E.E4[1]) || E1.E5.String() != u.String() || E1.E6.String() != u.String() ||
+		E1.E7 != uuid || E1.E8[0] != uuid || E1.E8[1] != (llsn.UUID{}) ||
+		E1.E9[0] != E.E9[0] || E1.E9[1] != E.E9[1] {
+		t.Fatalf("%v != %v", E1, E)
+	}
+
+	// UUID: header of version 2 (FEATURE_EXT), type code, extension ID,
+	// length and 16 bytes of payload
+	if b := llsn.Encode(&struct{ ID llsn.UUID }{uuid}).Bytes(); len(b) != 3+1+1+1+1+16 || b[2] != llsn.FEATURE_EXT {
+		t.Fatalf("UUID is encoded into %d bytes", len(b))
+	}
+
+	// the other arrays of 16 bytes are the regular arrays, the payload of
+	// UUID is decoded into them as well
+	var A struct{ ID [16]byte }
+	if b := llsn.Encode(&struct{ ID [16]byte }{uuid}).Bytes(); b[0]>>4 != llsn.VERSION || b[3] != llsn.TYPE_ARRAY {
+		t.Fatalf("[16]byte is encoded as %v", b)
+	}
+	if err := llsn.Decode(llsn.Encode(&struct{ ID llsn.UUID }{uuid}).Bytes(), &A); err != nil || A.ID != uuid {
+		t.Fatalf("%v != %v (%v)", A.ID, uuid, err)
+	}
+
+	fmt.Printf("TestLLSN_EXT: PASSED\n")
+}
+
+type ExampleEvent interface {
+	Kind() string
+}
+
+type ExampleOrder struct {
+	ID    uint64
+	Items []string
+	Price float64
+	F4    int8
+	F5    int16
+	F6    int32
+	F7    bool
+	F8    *string
+	F9    time.Time
+	F10   ExampleStruct
+}
+
+func (o ExampleOrder) Kind() string { return "order" }
+
+type ExampleCancel struct {
+	ID     uint64
+	Reason string
+}
+
+func (c *ExampleCancel) Kind() string { return "cancel" }
+
+type ExampleEnvelope struct {
+	Seq      int64
+	Payload  interface{}
+	Event    ExampleEvent
+	Events   []ExampleEvent
+	Anything []interface{}
+}
+
+func init() {
+	llsn.Register("test.Order", ExampleOrder{})
+	llsn.Register("test.Cancel", ExampleCancel{})
+	llsn.Register("test.Struct", ExampleStruct{})
+}
+
+func TestLLSN_INTERFACE(t *testing.T) {
+	var E1 ExampleEnvelope
+
+	order := ExampleOrder{ID: 7, Items: []string{"a", "b"}, Price: 9.99, F10: ExampleStruct{1, &ExampleStruct{2, nil}}}
+	E := ExampleEnvelope{1, order, &ExampleCancel{8, "timeout"},
+		[]ExampleEvent{nil, order, &ExampleCancel{9, ""}},
+		[]interface{}{ExampleStruct{3, nil}, nil, &ExampleStruct{4, nil}}}
+
+	if err := llsn.Decode(llsn.Encode(&E).Bytes(), &E1); err != nil {
+		t.Fatal(err)
+	}
+
+	o, ok := E1.Payload.(ExampleOrder)
+	if !ok || o.ID != 7 || o.Items[1] != "b" || o.Price != 9.99 || o.F10.Field2.Field1 != 2 {
+		t.Fatalf("Payload: %#v", E1.Payload)
+	}
+
+	if c, ok := E1.Event.(*ExampleCancel); !ok || c.Reason != "timeout" {
+		t.Fatalf("Event: %#v", E1.Event)
+	}
+
+	if E1.Events[0] != nil || E1.Events[1].Kind() != "order" || E1.Events[2].(*ExampleCancel).ID != 9 {
+		t.Fatalf("Events: %#v", E1.Events)
+	}
+
+	if E1.Anything[0].(ExampleStruct).Field1 != 3 || E1.Anything[1] != nil ||
+		E1.Anything[2].(ExampleStruct).Field1 != 4 {
+		t.Fatalf("Anything: %#v", E1.Anything)
+	}
+
+	// unregistered type
+	unknown := bytes.Replace(llsn.Encode(&E).Bytes(), []byte("test.Order"), []byte("test.Xrder"), -1)
+
+	err := llsn.Decode(unknown, &E1)
+	if e, ok := err.(*llsn.ErrorLLSN); !ok || e.Code() != llsn.ERR_UNREGISTERED_TYPE {
+		t.Fatalf("expected ERR_UNREGISTERED_TYPE, got %v", err)
+	}
+
+	var E2 struct {
+		Seq      int64
+		Payload  interface{}
+		Event    interface{}
+		Events   []interface{}
+		Anything []interface{}
+	}
+
+	if err := llsn.Decode(unknown, &E2); err != nil {
+		t.Fatal(err)
+	}
+
+	v, ok := E2.Payload.(llsn.Value)
+	if !ok || v.Name != "test.Xrder" || v.Type != llsn.TYPE_STRUCT || v.Items[0].Data.(uint64) != 7 ||
+		v.Items[1].Items[1].Data.(string) != "b" || !v.Items[7].IsNull() || v.Items[9].Items[1].Items[0].Data.(int64) != 2 {
+		t.Fatalf("Value: %#v", E2.Payload)
+	}
+
+	if v, ok := E2.Events[1].(llsn.Value); !ok || v.Name != "test.Xrder" {
+		t.Fatalf("Value: %#v", E2.Events[1])
+	}
+
+	fmt.Printf("TestLLSN_INTERFACE: PASSED\n")
+}
+
+type ExampleItemV1 struct {
+	Name  string
+	Price float64
+}
+
+type ExampleItemV2 struct {
+	Name    string
+	Price   float64
+	Comment string
+	Tags    []string
+	Owner   *ExampleStruct
+	Extra   [10]int64
+}
+
+type ExampleOrderV1 struct {
+	ID    uint64
+	Note  string
+	Items []ExampleItemV1
+}
+
+type ExampleOrderV2 struct {
+	ID      uint64
+	Note    string
+	Items   []ExampleItemV2
+	Blob    llsn.Blob
+	Created time.Time
+	File    *llsn.File
+	Total   *float64
+}
+
+func TestLLSN_schema_evolution(t *testing.T) {
+	var O1 ExampleOrderV1
+	var O2 ExampleOrderV2
+	var total float64 = 123.5
+
+	llsn.SetOption("threshold", 4)
+
+	// new sender, old receiver. extra fields are skipped including the
+	// tailed data (strings, blobs and files)
+	V2 := ExampleOrderV2{1, "long note", []ExampleItemV2{
+		{"first item", 1.5, "long comment", []string{"a", "long tag"}, &ExampleStruct{1, nil}, [10]int64{1, 2, 3}},
+		{"second", 2.5, "", nil, nil, [10]int64{}}},
+		llsn.Blob{1, 2, 3, 4, 5, 6}, time.Now(), &llsn.File{Name: "/tmp/llsntestfile"}, &total}
+
+	if err := llsn.Decode(llsn.Encode(&V2).Bytes(), &O1); err != nil {
+		t.Fatal(err)
+	}
+
+	if O1.ID != 1 || O1.Note != "long note" || len(O1.Items) != 2 || O1.Items[0].Name != "first item" ||
+		O1.Items[0].Price != 1.5 || O1.Items[1].Name != "second" || O1.Items[1].Price != 2.5 {
+		t.Fatalf("%v != %v", O1, V2)
+	}
+
+	// old sender, new receiver. missing fields keep zero values
+	V1 := ExampleOrderV1{2, "note", []ExampleItemV1{{"first item", 1.5}, {"second", 2.5}}}
+
+	if err := llsn.Decode(llsn.Encode(&V1).Bytes(), &O2); err != nil {
+		t.Fatal(err)
+	}
+
+	if O2.ID != 2 || O2.Items[1].Name != "second" || O2.Items[1].Comment != "" ||
+		O2.Items[0].Owner != nil || O2.Blob != nil || O2.File != nil || O2.Total != nil {
+		t.Fatalf("%v != %v", O2, V1)
+	}
+
+	// mismatched types are skipped
+	var O3 struct {
+		ID    string
+		Note  string
+		Items [1]ExampleItemV1
+	}
+
+	if err := llsn.Decode(llsn.Encode(&V1).Bytes(), &O3); err != nil {
+		t.Fatal(err)
+	}
+
+	if O3.ID != "" || O3.Note != "note" || O3.Items[0].Price != 1.5 {
+		t.Fatalf("%v != %v", O3, V1)
+	}
+
+	// strict mode reports the mismatches
+	llsn.SetOption("strict", true)
+	defer llsn.SetOption("strict", false)
+
+	for _, dst := range []interface{}{&O1, &O3} {
+		err := llsn.Decode(llsn.Encode(&V2).Bytes(), dst)
+		if _, ok := err.(*llsn.ErrorLLSN); !ok {
+			t.Fatalf("expected ErrorLLSN, got %v", err)
+		}
+	}
+
+	if err := llsn.Decode(llsn.Encode(&V2).Bytes(), &O2); err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Printf("TestLLSN_schema_evolution: PASSED\n")
+}
+
+type ExampleLineID1 struct {
+	Qty   int64   `llsn:"id=1"`
+	Price float64 `llsn:"id=2"`
+}
+
+type ExampleLineID2 struct {
+	SKU   string  `llsn:"id=3"`
+	Price float64 `llsn:"id=2"`
+	Qty   int64   `llsn:"id=1"`
+}
+
+type ExampleOrderID1 struct {
+	ID    uint64           `llsn:"id=1"`
+	Note  string           `llsn:"id=2"`
+	Lines []ExampleLineID1 `llsn:"id=3"`
+}
+
+type ExampleOrderID2 struct {
+	Lines  []*ExampleLineID2 `llsn:"id=3"`
+	Status string            `llsn:"id=4"`
+	ID     uint64            `llsn:"id=1"`
+}
+
+func TestLLSN_field_IDs(t *testing.T) {
+	var O1 ExampleOrderID1
+	var O2 ExampleOrderID2
+
+	llsn.SetOption("threshold", 4)
+
+	// fields are matched by ID regardless of order. unknown IDs are skipped
+	V2 := ExampleOrderID2{[]*ExampleLineID2{{"long sku", 1.5, 3}, nil, {"", 2.5, 4}},
+		"long status", 7}
+
+	if err := llsn.Decode(llsn.Encode(&V2).Bytes(), &O1); err != nil {
+		t.Fatal(err)
+	}
+
+	if O1.ID != 7 || O1.Note != "" || len(O1.Lines) != 3 || O1.Lines[0] != (ExampleLineID1{3, 1.5}) ||
+		O1.Lines[1] != (ExampleLineID1{}) || O1.Lines[2] != (ExampleLineID1{4, 2.5}) {
+		t.Fatalf("%v != %v", O1, V2)
+	}
+
+	V1 := ExampleOrderID1{8, "note", []ExampleLineID1{{1, 0.5}, {2, 1.5}}}
+
+	if err := llsn.Decode(llsn.Encode(&V1).Bytes(), &O2); err != nil {
+		t.Fatal(err)
+	}
+
+	if O2.ID != 8 || O2.Status != "" || len(O2.Lines) != 2 || *O2.Lines[1] != (ExampleLineID2{"", 1.5, 2}) {
+		t.Fatalf("%v != %v", O2, V1)
+	}
+
+	// legacy positional packets are decoded by position
+	var O3 ExampleOrderID1
+	L := ExampleOrderV1{9, "legacy", []ExampleItemV1{{"x", 3.5}}}
+
+	if err := llsn.Decode(llsn.Encode(&L).Bytes(), &O3); err != nil {
+		t.Fatal(err)
+	}
+
+	if O3.ID != 9 || O3.Note != "legacy" || len(O3.Lines) != 1 || O3.Lines[0].Price != 3.5 {
+		t.Fatalf("%v != %v", O3, L)
+	}
+
+	// strict mode reports the unknown and missing IDs
+	llsn.SetOption("strict", true)
+	defer llsn.SetOption("strict", false)
+
+	err := llsn.Decode(llsn.Encode(&V2).Bytes(), &O1)
+	if _, ok := err.(*llsn.ErrorLLSN); !ok {
+		t.Fatalf("expected ErrorLLSN, got %v", err)
+	}
+
+	if err := llsn.Decode(llsn.Encode(&V1).Bytes(), &O1); err != nil || O1.Note != "note" {
+		t.Fatal(err)
+	}
+
+	fmt.Printf("TestLLSN_field_IDs: PASSED\n")
+}
+
+type ExampleBase struct {
+	ID   uint64
+	Note string
+}
+
+type ExampleOrderFlat struct {
+	ExampleBase
+	Items []ExampleItemV1
+}
+
+type ExampleOrderFlatP struct {
+	*ExampleBase
+	Items []ExampleItemV1
+}
+
+type ExampleNoteA struct {
+	Note  string
+	Count int64
+}
+
+type ExampleNoteB struct {
+	Note string
+}
+
+type ExampleConflict struct {
+	ExampleNoteA
+	*ExampleNoteB
+	ID uint64
+}
+
+type ExampleBaseC struct {
+	ExampleBase
+}
+
+type ExampleBaseD struct {
+	ExampleBase
+}
+
+// ExampleBase is embedded twice at the same depth
+type ExampleDiamond struct {
+	ExampleBaseC
+	ExampleBaseD
+	Count int64
+}
+
+func TestLLSN_flatten(t *testing.T) {
+	var O1 ExampleOrderV1
+	var F ExampleOrderFlatP
+
+	llsn.SetOption("threshold", 0)
+	llsn.SetOption("flatten", true)
+	defer llsn.SetOption("flatten", false)
+
+	// extracted base struct doesn't change the wire format
+	V1 := ExampleOrderV1{1, "note", []ExampleItemV1{{"item", 1.5}}}
+	V2 := ExampleOrderFlat{ExampleBase{1, "note"}, []ExampleItemV1{{"item", 1.5}}}
+
+	b1 := llsn.Encode(&V1).Bytes()
+	b2 := llsn.Encode(&V2).Bytes()
+
+	if bytes.Compare(b1, b2) != 0 {
+		t.Fatalf("%v != %v", b1, b2)
+	}
+
+	if err := llsn.Decode(b2, &F); err != nil {
+		t.Fatal(err)
+	}
+
+	if F.ExampleBase == nil || F.ID != 1 || F.Note != "note" || F.Items[0].Name != "item" {
+		t.Fatalf("%v != %v", F, V2)
+	}
+
+	// promoted fields of nil embedded pointer are zero values
+	if err := llsn.Decode(llsn.Encode(&ExampleOrderFlatP{}).Bytes(), &O1); err != nil {
+		t.Fatal(err)
+	}
+
+	if O1.ID != 0 || O1.Note != "" || O1.Items != nil {
+		t.Fatalf("%v is not empty", O1)
+	}
+
+	// ambiguous fields are dropped
+	C := ExampleConflict{ExampleNoteA{"a", 2}, &ExampleNoteB{"b"}, 3}
+	P := struct {
+		Count int64
+		ID    uint64
+	}{2, 3}
+
+	if bytes.Compare(llsn.Encode(&C).Bytes(), llsn.Encode(&P).Bytes()) != 0 {
+		t.Fatalf("%v != %v", C, P)
+	}
+
+	D := ExampleDiamond{ExampleBaseC{ExampleBase{1, "c"}}, ExampleBaseD{ExampleBase{2, "d"}}, 3}
+	Q := struct{ Count int64 }{3}
+
+	if bytes.Compare(llsn.Encode(&D).Bytes(), llsn.Encode(&Q).Bytes()) != 0 {
+		t.Fatalf("%v != %v", D, Q)
+	}
+
+	fmt.Printf("TestLLSN_flatten: PASSED\n")
+}
+
+type ExampleHeader struct {
+	ID   uint64
+	Kind string
+}
+
+type ExampleMessage struct {
+	Header     ExampleHeader
+	Items      []ExampleItemV2
+	Attachment *llsn.File
+	Created    time.Time
+	Body       string
+}
+
+func exampleMessage() ExampleMessage {
+	return ExampleMessage{ExampleHeader{5, "long kind"},
+		[]ExampleItemV2{
+			{"first item", 1.5, "long comment", []string{"a", "long tag"}, &ExampleStruct{1, nil}, [10]int64{1}},
+			{"second", 2.5, "", nil, nil, [10]int64{}}},
+		&llsn.File{Name: "/tmp/llsntestfile"}, time.Now(), "long body"}
+}
+
+func TestLLSN_DecodeFields(t *testing.T) {
+	var E ExampleMessage
+
+	llsn.SetOption("threshold", 4)
+	V := exampleMessage()
+
+	err := llsn.DecodeFields(llsn.Encode(&V).Bytes(), &E, "Header.ID", "Items[*].Name", "Items[1].Price")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if E.Header.ID != 5 || E.Header.Kind != "" || len(E.Items) != 2 || E.Attachment != nil ||
+		!E.Created.IsZero() || E.Body != "" {
+		t.Fatalf("%v != %v", E, V)
+	}
+
+	if E.Items[0].Name != "first item" || E.Items[0].Price != 0 || E.Items[0].Tags != nil ||
+		E.Items[0].Owner != nil || E.Items[1].Name != "second" || E.Items[1].Price != 2.5 {
+		t.Fatalf("%v != %v", E.Items, V.Items)
+	}
+
+	if err := llsn.DecodeFields(llsn.Encode(&V).Bytes(), &E, "Items[1"); err == nil {
+		t.Fatal("expected error for invalid path")
+	}
+
+	fmt.Printf("TestLLSN_DecodeFields: PASSED\n")
+}
+
+func TestLLSN_Decoder(t *testing.T) {
+	var items []ExampleItemV2
+	var body string
+
+	llsn.SetOption("threshold", 4)
+	V := exampleMessage()
+
+	d, err := llsn.NewDecoder(llsn.Encode(&V).Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Header
+	if err := d.Skip(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Decode(&items); err != nil {
+		t.Fatal(err)
+	}
+
+	// Attachment, Created
+	for i := 0; i < 2; i++ {
+		if err := d.Skip(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := d.Decode(&body); err != nil || d.More() {
+		t.Fatal(err)
+	}
+
+	if len(items) != 2 || items[0].Comment != "long comment" || items[0].Tags[1] != "long tag" ||
+		items[1].Price != 2.5 || body != "long body" {
+		t.Fatalf("%v, %q != %v", items, body, V)
+	}
+
+	if err := d.Skip(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	fmt.Printf("TestLLSN_Decoder: PASSED\n")
+}
+
+func TestLLSN_Decoder_Skip_allocs(t *testing.T) {
+	llsn.SetOption("threshold", 4)
+	defer llsn.SetOption("threshold", 0)
+
+	allocs := func(n int) float64 {
+		var items []ExampleItemV2
+		for i := 0; i < n; i++ {
+			items = append(items, ExampleItemV2{"item", 1.5, "long comment",
+				[]string{"a", "long tag"}, &ExampleStruct{1, nil}, [10]int64{int64(i) << 20}})
+		}
+
+		b := llsn.Encode(&struct{ Items []ExampleItemV2 }{items}).Bytes()
+
+		decoder := testing.AllocsPerRun(10, func() {
+			llsn.NewDecoder(b)
+		})
+
+		return testing.AllocsPerRun(10, func() {
+			d, _ := llsn.NewDecoder(b)
+			if err := d.Skip(); err != nil || d.More() {
+				t.Fatal(err)
+			}
+		}) - decoder
+	}
+
+	if a2, a1000 := allocs(2), allocs(1000); a1000 > a2 {
+		t.Fatalf("Skip of 1000 items makes %v allocations, of 2 items - %v", a1000, a2)
+	}
+
+	fmt.Printf("TestLLSN_Decoder_Skip_allocs: PASSED\n")
+}
+
+func TestLLSN_Query(t *testing.T) {
+	llsn.SetOption("threshold", 4)
+	V := exampleMessage()
+	b := llsn.Encode(&V).Bytes()
+
+	for path, expected := range map[string]interface{}{
+		"Items[1].Price":   2.5,
+		"Items[0].Comment": "long comment", // tailed
+		"Items[0].Tags[1]": "long tag",
+		"Body":             "long body",
+		"Header.ID":        uint64(5),
+	} {
+		v, err := llsn.Query(b, path, ExampleMessage{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Data != expected {
+			t.Fatalf("%s: %v != %v", path, v.Data, expected)
+		}
+	}
+
+	// by position
+	if v, err := llsn.Query(b, "1[0].0"); err != nil || v.Type != llsn.TYPE_STRING || v.Data != "first item" {
+		t.Fatalf("%v != first item (%v)", v, err)
+	}
+
+	if v, err := llsn.Query(b, "Items[1].Owner", &V); err != nil || !v.IsNull() {
+		t.Fatalf("%v is not null (%v)", v, err)
+	}
+
+	for _, path := range []string{"1[5]", "0.0.1", "9"} {
+		_, err := llsn.Query(b, path)
+		if e, ok := err.(*llsn.ErrorLLSN); !ok || e.Code() != llsn.ERR_NOT_FOUND {
+			t.Fatalf("%s: expected ERR_NOT_FOUND, got %v", path, err)
+		}
+	}
+
+	if _, err := llsn.Query(b, "Header.Name", V); err == nil {
+		t.Fatal("expected error for unknown field")
+	}
+
+	if _, err := llsn.Query(b, "Header.ID"); err == nil {
+		t.Fatal("expected error for field name with no schema")
+	}
+
+	// tailed data after the selected value are not read
+	if v, err := llsn.Query(b[:len(b)-4], "Items[0].Comment", V); err != nil || v.Data != "long comment" {
+		t.Fatalf("%v != long comment (%v)", v, err)
+	}
+
+	// by field ID
+	I := ExampleOrderID2{[]*ExampleLineID2{{"sku", 1.5, 3}, nil, {"", 2.5, 4}}, "status", 7}
+	b = llsn.Encode(&I).Bytes()
+
+	if v, err := llsn.Query(b, "Lines[2].Price", ExampleOrderID1{}); err != nil || v.Data != 2.5 {
+		t.Fatalf("%v != 2.5 (%v)", v, err)
+	}
+
+	if v, err := llsn.Query(b, "3[2].1"); err != nil || v.Data != int64(4) {
+		t.Fatalf("%v != 4 (%v)", v, err)
+	}
+
+	fmt.Printf("TestLLSN_Query: PASSED\n")
+}
+
+func TestLLSN_index(t *testing.T) {
+	var E ExampleMessage
+	var body string
+	var file llsn.File
+
+	llsn.SetOption("threshold", 4)
+	V := exampleMessage()
+	plain := llsn.Encode(&V).Bytes()
+
+	llsn.SetOption("index", true)
+	b := llsn.Encode(&V).Bytes()
+	llsn.SetOption("index", false)
+
+	// the header of version 2 with FEATURE_INDEX
+	if b[0]>>4 != llsn.VERSION2 || b[2] != llsn.FEATURE_INDEX || !bytes.HasPrefix(b[3:], plain[2:]) {
+		t.Fatalf("indexed packet differs from the plain one")
+	}
+
+	// index is ignored by decoder
+	if err := llsn.Decode(append([]byte{}, b...), &E); err != nil || E.Body != V.Body {
+		t.Fatalf("%v != %v (%v)", E, V, err)
+	}
+
+	if _, err := llsn.NewReader(bytes.NewReader(plain), int64(len(plain))); err == nil {
+		t.Fatal("expected error for the packet with no index")
+	}
+
+	r, err := llsn.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.NumField() != 5 {
+		t.Fatalf("%d != 5", r.NumField())
+	}
+
+	if err := r.DecodeField(4, &body); err != nil || body != "long body" {
+		t.Fatalf("%q != long body (%v)", body, err)
+	}
+
+	if err := r.DecodeField(2, &file); err != nil {
+		t.Fatal(err)
+	}
+
+	orig, _ := os.ReadFile("/tmp/llsntestfile")
+	if err := file.SaveTo("/tmp/llsnindex_"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("/tmp/llsnindex_llsntestfile")
+
+	if saved, _ := os.ReadFile("/tmp/llsnindex_llsntestfile"); !bytes.Equal(saved, orig) {
+		t.Fatalf("%q != %q", saved, orig)
+	}
+
+	if v, err := r.Query("Items[0].Comment", V); err != nil || v.Data != "long comment" {
+		t.Fatalf("%v != long comment (%v)", v, err)
+	}
+
+	if v, err := r.Query("1[1].1"); err != nil || v.Data != 2.5 {
+		t.Fatalf("%v != 2.5 (%v)", v, err)
+	}
+
+	fmt.Printf("TestLLSN_index: PASSED\n")
+}
+
+func TestLLSN_index_channel(t *testing.T) {
+	var E ExampleMessage
+
+	llsn.SetOption("threshold", 4)
+	llsn.SetOption("index", true)
+	llsn.SetOption("chunk", 1)
+	defer llsn.SetOption("index", false)
+	defer llsn.SetOption("chunk", llsn.DEFAULT_CHUNK)
+
+	V := exampleMessage()
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 10; i++ {
+		channel := make(chan []byte)
+		go llsn.Encode(&V, channel)
+
+		if err := llsn.Decode(channel, &E); err != nil || E.Body != V.Body {
+			t.Fatalf("%v != %v (%v)", E, V, err)
+		}
+	}
+
+	// encoders are not blocked by the index nobody reads
+	for k := 0; runtime.NumGoroutine() > before; k++ {
+		if k == 100 {
+			t.Fatalf("%d goroutines are leaked", runtime.NumGoroutine()-before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the channel isn't read past the packet, it may stay open
+	llsn.SetOption("index", false)
+	channel := make(chan []byte, 2)
+	channel <- llsn.Encode(&V).Bytes()
+
+	done := make(chan error)
+	go func() { done <- llsn.Decode(channel, &E) }()
+
+	select {
+	case err := <-done:
+		if err != nil || E.Body != V.Body {
+			t.Fatalf("%v != %v (%v)", E, V, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Decode waits for the channel to be closed")
+	}
+
+	fmt.Printf("TestLLSN_index_channel: PASSED\n")
+}
+
+type ExampleRow struct {
+	ID   int64
+	Name string
+	Tags []string
+	Ref  *ExampleStruct
+}
+
+type ExampleResult struct {
+	Title string
+	Rows  llsn.Stream[*ExampleRow]
+	Total int64
+}
+
+type ExampleResultSlice struct {
+	Title string
+	Rows  []*ExampleRow
+	Total int64
+}
+
+func exampleRows(n int) func(func(*ExampleRow) bool) {
+	return func(yield func(*ExampleRow) bool) {
+		for i := 0; i < n; i++ {
+			var row *ExampleRow
+			if i%7 != 3 {
+				row = &ExampleRow{int64(i), fmt.Sprintf("long name %d", i), nil, nil}
+				if i%5 == 0 {
+					row.Tags = []string{"a", "long tag"}
+					row.Ref = &ExampleStruct{int64(i), nil}
+				}
+			}
+			if !yield(row) {
+				return
+			}
+		}
+	}
+}
+
+func TestLLSN_Stream(t *testing.T) {
+	var rows []*ExampleRow
+
+	llsn.SetOption("threshold", 4)
+
+	V := ExampleResult{"long title", llsn.NewStream(exampleRows(2500)), 2500}
+	b := llsn.Encode(&V).Bytes()
+
+	R := ExampleResult{Rows: llsn.StreamFunc(func(row *ExampleRow) error {
+		rows = append(rows, row)
+		return nil
+	})}
+
+	if err := llsn.Decode(append([]byte{}, b...), &R); err != nil {
+		t.Fatal(err)
+	}
+
+	if R.Title != "long title" || R.Total != 2500 || len(rows) != 2500 {
+		t.Fatalf("%q, %d, %d rows", R.Title, R.Total, len(rows))
+	}
+
+	check := func(rows []*ExampleRow) {
+		for i, row := range rows {
+			switch {
+			case i%7 == 3:
+				if row != nil {
+					t.Fatalf("row %d is not nil", i)
+				}
+			case row == nil || row.ID != int64(i) || row.Name != fmt.Sprintf("long name %d", i):
+				t.Fatalf("row %d: %v", i, row)
+			case i%5 == 0 && (row.Tags[1] != "long tag" || row.Ref.Field1 != int64(i)):
+				t.Fatalf("row %d: %v", i, row)
+			}
+		}
+	}
+	check(rows)
+
+	// stream is decoded into the slice
+	var S ExampleResultSlice
+	if err := llsn.Decode(append([]byte{}, b...), &S); err != nil {
+		t.Fatal(err)
+	}
+	check(S.Rows)
+
+	// callback error stops decoding
+	stop := errors.New("stop")
+	R.Rows = llsn.StreamFunc(func(row *ExampleRow) error { return stop })
+	if err := llsn.Decode(append([]byte{}, b...), &R); err != stop {
+		t.Fatalf("expected %v, got %v", stop, err)
+	}
+
+	// zero stream is empty
+	E := ExampleResult{Title: "empty", Total: 0}
+	if err := llsn.Decode(llsn.Encode(&E).Bytes(), &S); err != nil || len(S.Rows) != 0 || S.Title != "empty" {
+		t.Fatalf("%v (%v)", S, err)
+	}
+
+	// iterator is released when the encoding fails
+	released := make(chan bool, 1)
+	files := func(yield func(llsn.File) bool) {
+		defer func() { released <- true }()
+		for yield(llsn.File{Name: "/nonexistent/llsnfile"}) {
+		}
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatal("expected panic for the missing file")
+			}
+		}()
+		llsn.Encode(&struct{ Files llsn.Stream[llsn.File] }{llsn.NewStream(files)})
+	}()
+
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("iterator of stream is not released")
+	}
+
+	fmt.Printf("TestLLSN_Stream: PASSED\n")
+}
+
+func TestLLSN_DecodeArray(t *testing.T) {
+	var rows []*ExampleRow
+
+	collect := func(row **ExampleRow) error {
+		rows = append(rows, *row)
+		return nil
+	}
+
+	check := func(n int) {
+		if len(rows) != n {
+			t.Fatalf("expected %d rows, got %d", n, len(rows))
+		}
+		for i, row := range rows {
+			switch {
+			case i%7 == 3:
+				if row != nil {
+					t.Fatalf("row %d is not nil", i)
+				}
+			case row == nil || row.ID != int64(i) || row.Name != fmt.Sprintf("long name %d", i):
+				t.Fatalf("row %d: %v", i, row)
+			case i%5 == 0 && (row.Tags[1] != "long tag" || row.Ref.Field1 != int64(i)):
+				t.Fatalf("row %d: %v", i, row)
+			}
+		}
+		rows = nil
+	}
+
+	S := ExampleResultSlice{Title: "long title", Total: 100}
+	for row := range exampleRows(100) {
+		S.Rows = append(S.Rows, row)
+	}
+
+	for _, th := range []int{0, 4} {
+		llsn.SetOption("threshold", th)
+		b := llsn.Encode(&S).Bytes()
+
+		if err := llsn.DecodeArray(append([]byte{}, b...), "Rows", collect, ExampleResultSlice{}); err != nil {
+			t.Fatal(err)
+		}
+		check(100)
+
+		// positional path
+		if err := llsn.DecodeArray(append([]byte{}, b...), "1", collect); err != nil {
+			t.Fatal(err)
+		}
+		check(100)
+
+		// the single field of element
+		var tags []string
+		err := llsn.DecodeArray(append([]byte{}, b...), "Rows[5].Tags", func(tag *string) error {
+			tags = append(tags, *tag)
+			return nil
+		}, ExampleResultSlice{})
+		if err != nil || len(tags) != 2 || tags[1] != "long tag" {
+			t.Fatalf("%v (%v)", tags, err)
+		}
+
+		// not an array
+		err = llsn.DecodeArray(append([]byte{}, b...), "Title", collect, ExampleResultSlice{})
+		if e, ok := err.(*llsn.ErrorLLSN); !ok || e.Code() != llsn.ERR_TYPE_MISMATCH {
+			t.Fatalf("expected ERR_TYPE_MISMATCH, got %v", err)
+		}
+	}
+
+	// stream
+	llsn.SetOption("threshold", 4)
+	V := ExampleResult{"long title", llsn.NewStream(exampleRows(2500)), 2500}
+	b := llsn.Encode(&V).Bytes()
+
+	if err := llsn.DecodeArray(append([]byte{}, b...), "Rows", collect, ExampleResult{}); err != nil {
+		t.Fatal(err)
+	}
+	check(2500)
+
+	// break of the loop stops decoding
+	n := 0
+	for row, err := range llsn.Elements[*ExampleRow](append([]byte{}, b...), "Rows", ExampleResult{}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n++; n == 10 {
+			if (*row).ID != 9 {
+				t.Fatalf("row 9: %v", *row)
+			}
+			break
+		}
+	}
+
+	// the error is yielded last
+	for row, err := range llsn.Elements[*ExampleRow](append([]byte{}, b...), "Rows[1]", ExampleResult{}) {
+		if row != nil || err == nil {
+			t.Fatalf("expected the error, got %v (%v)", row, err)
+		}
+	}
+
+	// panic of the loop body is not turned into the error
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Fatalf("expected panic boom, got %v", r)
+			}
+		}()
+
+		for range llsn.Elements[*ExampleRow](append([]byte{}, b...), "Rows", ExampleResult{}) {
+			panic("boom")
+		}
+	}()
+
+	llsn.SetOption("threshold", 0)
+	fmt.Printf("TestLLSN_DecodeArray: PASSED\n")
+}
+
+type ExampleUnsupported struct {
+	ID    int64
+	Attrs []map[string]string
+}
+
+func TestLLSN_Codec(t *testing.T) {
+	llsn.SetOption("threshold", 4)
+	defer llsn.SetOption("threshold", 0)
+
+	b, err := llsn.Marshal(&exampleMainValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b, exampleMainValueEncoded) {
+		t.Fatalf("encoded result is incorrect")
+	}
+
+	E, err := llsn.Unmarshal[ExampleMain](b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := compareComplexStruct(&E, &exampleMainValue); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := llsn.NewCodec[ExampleHeader]()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	M := ExampleHeader{5, "long kind"}
+	if b, err = c.Marshal(&M); err != nil {
+		t.Fatal(err)
+	}
+
+	var M1 ExampleHeader
+	if err := c.UnmarshalTo(b, &M1); err != nil || M != M1 {
+		t.Fatalf("%v != %v (%v)", M, M1, err)
+	}
+
+	// misuse
+	if _, err := c.Marshal(nil); err == nil {
+		t.Fatalf("nil value is encoded")
+	}
+	if _, err := llsn.NewCodec[map[string]int](); err == nil {
+		t.Fatalf("codec of map is created")
+	}
+	if _, err := llsn.Marshal(&ExampleUnsupported{}); err == nil {
+		t.Fatalf("map is encoded")
+	}
+
+	fmt.Printf("TestLLSN_Codec: PASSED\n")
+}
+
+func TestLLSN_topLevel(t *testing.T) {
+	llsn.SetOption("threshold", 4)
+	defer llsn.SetOption("threshold", 0)
+
+	// array
+	var rows []*ExampleRow
+	for row := range exampleRows(20) {
+		rows = append(rows, row)
+	}
+
+	var rows1 []*ExampleRow
+	if err := llsn.Decode(llsn.Encode(&rows).Bytes(), &rows1); err != nil {
+		t.Fatal(err)
+	}
+	for i, row := range rows1 {
+		if (row == nil) != (rows[i] == nil) || row != nil && row.Name != rows[i].Name {
+			t.Fatalf("row %d: %v", i, row)
+		}
+	}
+
+	// scalars
+	var s string
+	if err := llsn.Decode(llsn.Encode("long string").Bytes(), &s); err != nil || s != "long string" {
+		t.Fatalf("%q (%v)", s, err)
+	}
+
+	n := int64(-42)
+	var pn *int64
+	if err := llsn.Decode(llsn.Encode(&n).Bytes(), &pn); err != nil || *pn != n {
+		t.Fatalf("%v (%v)", pn, err)
+	}
+
+	var pnil *int64
+	if err := llsn.Decode(llsn.Encode(&pnil).Bytes(), &pn); err != nil || pn != nil {
+		t.Fatalf("%v (%v)", pn, err)
+	}
+
+	d := time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)
+	var d1 time.Time
+	if err := llsn.Decode(llsn.Encode(d).Bytes(), &d1); err != nil || !d1.Equal(d) {
+		t.Fatalf("%v (%v)", d1, err)
+	}
+
+	// special structs are the single values
+	f := llsn.File{Name: "/tmp/llsntestfile"}
+	var f1 llsn.File
+	if err := llsn.Decode(llsn.Encode(&f).Bytes(), &f1); err != nil || f1.Name != "llsntestfile" {
+		t.Fatalf("%v (%v)", f1, err)
+	}
+
+	var v llsn.Value
+	if err := llsn.Decode(llsn.Encode(&rows).Bytes(), &v); err != nil || v.Type != llsn.TYPE_ARRAYN || len(v.Items) != 20 {
+		t.Fatalf("%v (%v)", v, err)
+	}
+
+	// typed helpers
+	b, err := llsn.Marshal(&rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows1, err = llsn.Unmarshal[[]*ExampleRow](b); err != nil || len(rows1) != 20 {
+		t.Fatalf("%d rows (%v)", len(rows1), err)
+	}
+
+	// struct isn't decoded into the single value
+	V := ExampleHeader{5, "long kind"}
+	var id uint64
+	err = llsn.Decode(llsn.Encode(&V).Bytes(), &id)
+	if e, ok := err.(*llsn.ErrorLLSN); !ok || e.Code() != llsn.ERR_FIELDS_MISMATCH {
+		t.Fatalf("expected ERR_FIELDS_MISMATCH, got %v", err)
+	}
+
+	// neither the value of other kind
+	err = llsn.Decode(llsn.Encode("long string").Bytes(), &id)
+	if e, ok := err.(*llsn.ErrorLLSN); !ok || e.Code() != llsn.ERR_TYPE_MISMATCH {
+		t.Fatalf("expected ERR_TYPE_MISMATCH, got %v", err)
+	}
+
+	// generic value gets all the fields of struct
+	if err := llsn.Decode(llsn.Encode(&V).Bytes(), &v); err != nil || v.Type != llsn.TYPE_STRUCT ||
+		len(v.Items) != 2 || v.Items[0].Data != uint64(5) || v.Items[1].Data != "long kind" {
+		t.Fatalf("%v (%v)", v, err)
+	}
+
+	fmt.Printf("TestLLSN_topLevel: PASSED\n")
+}
+
+// exampleCompressor passes the data as is and counts the written bytes
+type exampleCompressor struct {
+	written *int
+}
+
+type exampleWriter struct {
+	io.Writer
+	written *int
+}
+
+func (w exampleWriter) Write(p []byte) (int, error) {
+	*w.written += len(p)
+	return w.Writer.Write(p)
+}
+
+func (w exampleWriter) Close() error {
+	return nil
+}
+
+func (c exampleCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return exampleWriter{w, c.written}, nil
+}
+
+func (c exampleCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(r), nil
+}
+
+var exampleCompressed int
+
+func init() {
+	llsn.RegisterCompressor(64, exampleCompressor{&exampleCompressed})
+}
+
+func TestLLSN_compress(t *testing.T) {
+	llsn.SetOption("threshold", 4)
+	defer llsn.SetOption("threshold", 0)
+	defer llsn.SetOption("compress", llsn.COMPRESS_NONE)
+
+	for _, id := range []int{llsn.COMPRESS_GZIP, llsn.COMPRESS_DEFLATE, 64} {
+		var E1, E2 ExampleMain
+
+		llsn.SetOption("compress", id)
+		b := llsn.Encode(&exampleMainValue).Bytes()
+
+		if b[0]>>4 != llsn.VERSION2 || b[3] != byte(id) {
+			t.Fatalf("header % x", b[:4])
+		}
+
+		if err := llsn.Decode(b, &E1); err != nil {
+			t.Fatal(err)
+		}
+		if err := compareComplexStruct(&E1, &exampleMainValue); err != nil {
+			t.Fatalf("compressor %d: %s", id, err)
+		}
+
+		// via channel
+		chn := make(chan []byte)
+		go func() {
+			for k := 0; k < len(b); k += 7 {
+				chn <- b[k:min(k+7, len(b))]
+			}
+			close(chn)
+		}()
+
+		if err := llsn.Decode(chn, &E2); err != nil {
+			t.Fatal(err)
+		}
+		if err := compareComplexStruct(&E2, &exampleMainValue); err != nil {
+			t.Fatalf("compressor %d: %s", id, err)
+		}
+	}
+
+	// the body follows the 2 bytes of header
+	if exampleCompressed != len(exampleMainValueEncoded)-2 {
+		t.Fatalf("%d bytes are compressed, expected %d", exampleCompressed,
+			len(exampleMainValueEncoded)-2)
+	}
+
+	// repeated data are compressed
+	llsn.SetOption("compress", llsn.COMPRESS_GZIP)
+	var rows []*ExampleRow
+	for row := range exampleRows(1000) {
+		rows = append(rows, row)
+	}
+
+	b := llsn.Encode(&rows).Bytes()
+	llsn.SetOption("compress", llsn.COMPRESS_NONE)
+	plain := llsn.Encode(&rows).Bytes()
+	if len(b) > len(plain)/3 {
+		t.Fatalf("%d bytes compressed, %d bytes plain", len(b), len(plain))
+	}
+
+	// unknown compressor
+	b[3] = 99
+	if err := llsn.Decode(b, &rows); err == nil {
+		t.Fatalf("unknown compressor is accepted")
+	}
+
+	fmt.Printf("TestLLSN_compress: PASSED\n")
+}
+
+func TestLLSN_checksum(t *testing.T) {
+	var E ExampleMessage
+
+	expectChecksum := func(err error) {
+		t.Helper()
+		if e, ok := err.(*llsn.ErrorLLSN); !ok || e.Code() != llsn.ERR_CHECKSUM {
+			t.Fatalf("expected ERR_CHECKSUM, got %v", err)
+		}
+	}
+
+	viaChannel := func(b []byte) chan []byte {
+		chn := make(chan []byte)
+		go func() {
+			for k := 0; k < len(b); k += 5 {
+				chn <- b[k:min(k+5, len(b))]
+			}
+			close(chn)
+		}()
+		return chn
+	}
+
+	llsn.SetOption("threshold", 4)
+	llsn.SetOption("checksum", true)
+	defer llsn.SetOption("threshold", 0)
+	defer llsn.SetOption("checksum", false)
+
+	V := exampleMessage()
+	b := llsn.Encode(&V).Bytes()
+	body := bytes.Index(b, []byte("long body"))
+
+	if err := llsn.Decode(append([]byte{}, b...), &E); err != nil || E.Body != V.Body {
+		t.Fatalf("%v != %v (%v)", E, V, err)
+	}
+	if err := llsn.Decode(viaChannel(b), &E); err != nil || E.Body != V.Body {
+		t.Fatalf("%v != %v (%v)", E, V, err)
+	}
+
+	// the packet is verified before decoding
+	c := append([]byte{}, b...)
+	c[5]++
+	expectChecksum(llsn.Decode(c, &E))
+
+	// the corrupted tailed data are detected after decoding
+	c = append([]byte{}, b...)
+	c[body]++
+	expectChecksum(llsn.Decode(viaChannel(c), &E))
+	if _, err := llsn.Query(append([]byte{}, c...), "4"); err == nil {
+		t.Fatalf("corrupted packet is queried")
+	}
+
+	// compressed packet is checksummed as is
+	llsn.SetOption("compress", llsn.COMPRESS_GZIP)
+	b = llsn.Encode(&V).Bytes()
+	llsn.SetOption("compress", llsn.COMPRESS_NONE)
+
+	if err := llsn.Decode(viaChannel(b), &E); err != nil || E.Body != V.Body {
+		t.Fatalf("%v != %v (%v)", E, V, err)
+	}
+
+	c = append([]byte{}, b...)
+	c[len(c)-1]++
+	expectChecksum(llsn.Decode(viaChannel(c), &E))
+
+	// the index follows the checksum
+	llsn.SetOption("index", true)
+	b = llsn.Encode(&V).Bytes()
+	llsn.SetOption("index", false)
+
+	if err := llsn.Decode(append([]byte{}, b...), &E); err != nil || E.Body != V.Body {
+		t.Fatalf("%v != %v (%v)", E, V, err)
+	}
+
+	r, err := llsn.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.DecodeField(4, &E.Body); err != nil || E.Body != V.Body {
+		t.Fatalf("%q (%v)", E.Body, err)
+	}
+
+	// file digests
+	llsn.SetOption("checksum", false)
+	llsn.SetOption("digest", true)
+	defer llsn.SetOption("digest", false)
+
+	b = llsn.Encode(&V).Bytes()
+
+	E = ExampleMessage{}
+	if err := llsn.Decode(append([]byte{}, b...), &E); err != nil || E.Attachment == nil {
+		t.Fatalf("%v (%v)", E, err)
+	}
+
+	// skipped files
+	E = ExampleMessage{}
+	if err := llsn.DecodeFields(append([]byte{}, b...), &E, "Body"); err != nil || E.Body != V.Body {
+		t.Fatalf("%v (%v)", E, err)
+	}
+
+	// broken file is removed
+	tmp := t.TempDir()
+	llsn.SetOption("dir", tmp)
+	defer llsn.SetOption("dir", llsn.DECODE_FOLDER)
+
+	c = append([]byte{}, b...)
+	c[bytes.Index(c, []byte("This is demo file."))]++
+	expectChecksum(llsn.Decode(c, &E))
+
+	if files, err := os.ReadDir(tmp); err != nil || len(files) != 0 {
+		t.Fatalf("%d files are left (%v)", len(files), err)
+	}
+
+	llsn.SetOption("index", true)
+	b = llsn.Encode(&V).Bytes()
+	llsn.SetOption("index", false)
+
+	if r, err = llsn.NewReader(bytes.NewReader(b), int64(len(b))); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.DecodeField(4, &E.Body); err != nil || E.Body != V.Body {
+		t.Fatalf("%q (%v)", E.Body, err)
+	}
+	var file llsn.File
+	if err := r.DecodeField(2, &file); err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Printf("TestLLSN_checksum: PASSED\n")
+}
+
+func TestLLSN_version(t *testing.T) {
+	var E ExampleMessage
+
+	V := exampleMessage()
+	V.Attachment = nil
+
+	// plain packet has the header of version 1
+	b := llsn.Encode(&V).Bytes()
+	if b[0]>>4 != llsn.VERSION {
+		t.Fatalf("version %d, expected %d", b[0]>>4, llsn.VERSION)
+	}
+
+	llsn.SetOption("version", llsn.VERSION2)
+	b = llsn.Encode(&V).Bytes()
+	if b[0]>>4 != llsn.VERSION2 || b[2] != 0 {
+		t.Fatalf("header %v, expected version %d", b[:3], llsn.VERSION2)
+	}
+	if err := llsn.Decode(append([]byte{}, b...), &E); err != nil || E.Body != V.Body {
+		t.Fatalf("%v != %v (%v)", E, V, err)
+	}
+
+	// unknown versions are rejected
+	c := append([]byte{}, b...)
+	c[0] = 3 << 4
+	if err := llsn.Decode(c, &E); err == nil {
+		t.Fatalf("unknown version is accepted")
+	}
+
+	// features can't be encoded with version 1
+	llsn.SetOption("version", llsn.VERSION)
+	llsn.SetOption("checksum", true)
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatalf("checksum is encoded with version 1")
+			}
+		}()
+		llsn.Encode(&V)
+	}()
+	llsn.SetOption("checksum", false)
+
+	// the built-in extensions have the encodings of version 1
+	u, _ := url.Parse("https://allyst.org/opensource/llsn/")
+	type Legacy struct {
+		E1 time.Duration
+		E3 net.IP
+		E5 *url.URL
+		E6 url.URL
+		E7 llsn.UUID
+		E8 []llsn.UUID
+	}
+	L := Legacy{time.Second, net.ParseIP("192.168.0.1"), u, *u, llsn.UUID{1, 2}, []llsn.UUID{{3}}}
+	var L1 Legacy
+
+	b = llsn.Encode(&L).Bytes()
+	if b[0]>>4 != llsn.VERSION || b[3] != llsn.TYPE_NUMBER {
+		t.Fatalf("extension is encoded with version 1: %v", b)
+	}
+	if err := llsn.Decode(b, &L1); err != nil || L1.E1 != L.E1 || !L1.E3.Equal(L.E3) ||
+		L1.E5.String() != u.String() || L1.E6.String() != u.String() || L1.E7 != L.E7 || L1.E8[0] != L.E8[0] {
+		t.Fatalf("%v != %v (%v)", L1, L, err)
+	}
+
+	// neither the registered extensions nor the other type codes of version 2
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatalf("TYPE_EXT is encoded with version 1")
+			}
+		}()
+		llsn.Encode(&struct{ P ExamplePoint }{ExamplePoint{1, 2}})
+	}()
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatalf("TYPE_BIGNUMBER is encoded with version 1")
+			}
+		}()
+		llsn.Encode(&struct{ N *big.Int }{big.NewInt(1)})
+	}()
+	llsn.SetOption("version", 0)
+
+	b = llsn.Encode(&struct{ D time.Duration }{time.Second}).Bytes()
+	if b[0]>>4 != llsn.VERSION2 || b[2] != llsn.FEATURE_EXT {
+		t.Fatalf("header %v, expected FEATURE_EXT", b[:3])
+	}
+
+	f := llsn.Supported()
+	if !f.Accepts(llsn.VERSION, 0, 0) || !f.Accepts(llsn.VERSION2, llsn.FEATURE_COMPRESS, llsn.COMPRESS_GZIP) {
+		t.Fatalf("%v doesn't accept the supported features", f)
+	}
+	if f.Accepts(llsn.VERSION, llsn.FEATURE_CHECKSUM, 0) || f.Accepts(llsn.VERSION2, llsn.FEATURE_COMPRESS, 200) {
+		t.Fatalf("%v accepts the unsupported features", f)
+	}
+	if !f.Accepts(llsn.VERSION2, llsn.FEATURE_LOSSLESS|llsn.FEATURE_STREAM, 0) ||
+		f.Accepts(llsn.VERSION, llsn.FEATURE_LOSSLESS, 0) {
+		t.Fatalf("%v: type codes of version 2", f)
+	}
+
+	// the old peer accepts no type codes of version 2
+	old := llsn.Features{Versions: []uint8{llsn.VERSION, llsn.VERSION2},
+		Flags: llsn.FEATURE_COMPRESS | llsn.FEATURE_CHECKSUM | llsn.FEATURE_DIGEST}
+	if old.Accepts(llsn.VERSION2, llsn.FEATURE_EXT, 0) {
+		t.Fatalf("%v accepts TYPE_EXT", old)
+	}
+
+	// features are exchanged by peers
+	var peer llsn.Features
+	if err := llsn.Decode(llsn.Encode(&f).Bytes(), &peer); err != nil || peer.Flags != f.Flags ||
+		len(peer.Compressors) != len(f.Compressors) {
+		t.Fatalf("%v != %v (%v)", peer, f, err)
+	}
+
+	fmt.Printf("TestLLSN_version: PASSED\n")
+}
+
+func TestLLSN_sign(t *testing.T) {
+	var E ExampleMessage
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the options don't change the canonical encoding
+	llsn.SetOption("threshold", 4)
+	llsn.SetOption("checksum", true)
+	defer llsn.SetOption("threshold", 0)
+	defer llsn.SetOption("checksum", false)
+
+	V := exampleMessage()
+	V.Attachment = nil
+
+	sig, err := llsn.Sign(&V, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := llsn.Canonical(V)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// lossless date needs the header of version 2
+	if b[0]>>4 != llsn.VERSION2 || b[2] != llsn.FEATURE_LOSSLESS ||
+		bytes.Contains(b[bytes.Index(b, []byte("long body"))+9:], []byte("long")) {
+		t.Fatalf("packet isn't canonical: %v", b)
+	}
+
+	// decoded and encoded back
+	if err := llsn.Decode(b, &E); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := llsn.Verify(&E, sig, pub); !ok || err != nil {
+		t.Fatalf("decoded value isn't verified (%v)", err)
+	}
+
+	// the same instant in the other zone
+	zone := time.FixedZone("test", 5*3600)
+	E.Created = E.Created.In(zone)
+	if ok, _ := llsn.Verify(&E, sig, pub); !ok {
+		t.Fatalf("date in %s isn't verified", zone)
+	}
+
+	E.Body = "modified"
+	if ok, _ := llsn.Verify(&E, sig, pub); ok {
+		t.Fatalf("modified value is verified")
+	}
+
+	if _, err := llsn.Sign(&ExampleUnsupported{}, priv); err == nil {
+		t.Fatalf("unsupported value is signed")
+	}
+
+	fmt.Printf("TestLLSN_sign: PASSED\n")
+}
+
+type ExampleEvents struct {
+	Name   string
+	Events llsn.Stream[int]
+}
+
+func TestLLSN_Size(t *testing.T) {
+	options := []struct {
+		name  string
+		value interface{}
+	}{
+		{"threshold", 4}, {"index", true}, {"checksum", true}, {"digest", true},
+		{"compress", llsn.COMPRESS_GZIP}, {"compress", llsn.COMPRESS_NONE},
+		{"canonical", true},
+	}
+
+	defer func() {
+		llsn.SetOption("threshold", 0)
+		llsn.SetOption("index", false)
+		llsn.SetOption("checksum", false)
+		llsn.SetOption("digest", false)
+		llsn.SetOption("canonical", false)
+	}()
+
+	V := exampleMessage()
+	items := V.Items
+
+	for _, o := range options {
+		llsn.SetOption(o.name, o.value)
+
+		for _, v := range []interface{}{&V, &exampleMainValue, &items, "long string", 5} {
+			size, err := llsn.Size(v)
+			if err != nil {
+				t.Fatalf("%s: %v", o.name, err)
+			}
+
+			if n := int64(llsn.Encode(v).Len()); size != n {
+				t.Fatalf("%s: size %d != %d (%T)", o.name, size, n, v)
+			}
+		}
+	}
+
+	if _, err := llsn.Size(nil); err == nil {
+		t.Fatal("expected error for nil")
+	}
+
+	if _, err := llsn.Size(&struct{ M map[string]int }{}); err == nil {
+		t.Fatal("expected error for unsupported type")
+	}
+
+	// streams are not consumed
+	llsn.Register("test.Events", ExampleEvents{})
+
+	var taken int
+	S := ExampleEvents{"events", llsn.NewStream(func(yield func(int) bool) {
+		for i := 0; i < 3 && yield(i); i++ {
+			taken++
+		}
+	})}
+
+	if _, err := llsn.Size(&S); err == nil || taken != 0 {
+		t.Fatalf("stream is counted (%v, %d elements taken)", err, taken)
+	}
+	if _, err := llsn.Size(&struct{ E interface{} }{S}); err == nil || taken != 0 {
+		t.Fatalf("stream of interface is counted (%v, %d elements taken)", err, taken)
+	}
+
+	var E struct {
+		Name   string
+		Events []int
+	}
+	if err := llsn.Decode(llsn.Encode(&S).Bytes(), &E); err != nil || len(E.Events) != 3 {
+		t.Fatalf("stream is consumed by Size: %v (%v)", E, err)
+	}
 }
 
 func TestLLSN_encodeComplexStruct(t *testing.T) {
@@ -226,6 +2082,13 @@ func BenchmarkLLSN_encodeComplexStruct(b *testing.B) {
 	}
 }
 
+func BenchmarkLLSN_encodeComplexStruct_pooled(b *testing.B) {
+	llsn.SetOption("threshold", 4)
+	for i := 0; i < b.N; i++ {
+		llsn.Release(llsn.Encode(&exampleMainValue))
+	}
+}
+
 func TestLLSN_encodeComplexStruct_via_channel(t *testing.T) {
 	channel := make(chan []byte)
 	tail := exampleMainValueEncoded
@@ -255,6 +2118,67 @@ func TestLLSN_encodeComplexStruct_via_channel(t *testing.T) {
 
 }
 
+func TestLLSN_encodeChunks(t *testing.T) {
+	defer llsn.SetOption("chunk", llsn.DEFAULT_CHUNK)
+
+	for _, size := range []int{1, 7, 64, llsn.DEFAULT_CHUNK} {
+		var buffer bytes.Buffer
+		var chunks int
+
+		llsn.SetOption("chunk", size)
+
+		channel := make(chan []byte)
+		go llsn.Encode(&exampleMainValue, channel)
+
+		for b := range channel {
+			buffer.Write(b)
+			chunks++
+		}
+
+		if !bytes.Equal(buffer.Bytes(), exampleMainValueEncoded) {
+			t.Fatalf("chunk %d: encoded result is incorrect", size)
+		}
+
+		if size > 1 && chunks > len(exampleMainValueEncoded)/size+20 {
+			t.Fatalf("chunk %d: data are not coalesced (%d chunks)", size, chunks)
+		}
+	}
+
+	// the data are sent before the chunk of slow stream is taken
+	release := make(chan struct{})
+	S := struct {
+		Name   string
+		Events llsn.Stream[int]
+	}{"head", llsn.NewStream(func(yield func(int) bool) {
+		<-release
+		yield(1)
+	})}
+
+	channel := make(chan []byte)
+	go llsn.Encode(&S, channel)
+
+	select {
+	case b := <-channel:
+		if !bytes.Contains(b, []byte("head")) {
+			t.Fatalf("chunk %v has no data before the stream", b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("data are held by the stream")
+	}
+	close(release)
+	for range channel {
+	}
+
+	// pooled buffers are reused
+	for i := 0; i < 3; i++ {
+		b := llsn.Encode(&exampleMainValue)
+		if !bytes.Equal(b.Bytes(), exampleMainValueEncoded) {
+			t.Fatalf("encoded result is incorrect")
+		}
+		llsn.Release(b)
+	}
+}
+
 func BenchmarkLLSN_encodeComplexStruct_via_channel(b *testing.B) {
 	llsn.SetOption("threshold", 4)
 	for i := 0; i < b.N; i++ {
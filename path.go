@@ -0,0 +1,274 @@
+// Golang support for LLSN - Allyst's data interchange format.
+// LLSN specification http://allyst.org/opensource/llsn/
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// copyright (C) 2015 Allyst Inc. http://allyst.com
+// author Taras Halturin <halturin@allyst.com>
+
+package llsn
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Paths select the fields of struct by name and the items of array by
+// index, '*' selects any item:
+//
+//	Header.ID
+//	Items[*].Name
+//	Matrix[1][*]
+//
+// The selected field is decoded with all of its subtree.
+
+// fieldMask is the parsed set of paths. nil mask selects everything
+type fieldMask struct {
+	fields map[string]*fieldMask
+	items  map[int]*fieldMask // -1 - any item
+	sink   *streamLevel       // items of the selected array (see DecodeArray)
+}
+
+// maskFunc reports whether the i'th item is selected and returns the mask of
+// its subtree
+type maskFunc func(int) (*fieldMask, bool)
+
+type pathElement struct {
+	name  string // field name. "" - array item
+	index int    // array item. -1 - any
+}
+
+// parsePath splits the path to the field names and array indexes
+func parsePath(path string) ([]pathElement, error) {
+	var elements []pathElement
+
+	if path == "" {
+		return nil, errors.New("Empty path")
+	}
+
+	for _, part := range strings.Split(path, ".") {
+		name := part
+		if i := strings.IndexByte(part, '['); i >= 0 {
+			name = part[:i]
+		}
+
+		if name == "" && (len(elements) == 0 || part == "") {
+			return nil, fmt.Errorf("Invalid path %q", path)
+		}
+
+		if name != "" {
+			elements = append(elements, pathElement{name: name})
+		}
+
+		for rest := part[len(name):]; rest != ""; {
+			end := strings.IndexByte(rest, ']')
+			if rest[0] != '[' || end < 0 {
+				return nil, fmt.Errorf("Invalid path %q", path)
+			}
+
+			index := -1
+			if rest[1:end] != "*" {
+				n, err := strconv.Atoi(rest[1:end])
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("Invalid index in path %q", path)
+				}
+				index = n
+			}
+
+			elements = append(elements, pathElement{index: index})
+			rest = rest[end+1:]
+		}
+	}
+
+	return elements, nil
+}
+
+// newFieldMask builds the mask of the 'paths'
+func newFieldMask(paths []string) (*fieldMask, error) {
+	mask := &fieldMask{}
+
+	for _, path := range paths {
+		elements, err := parsePath(path)
+		if err != nil {
+			return nil, err
+		}
+
+		m := mask
+		for i, e := range elements {
+			last := i == len(elements)-1
+			if m = m.add(e, last); m == nil {
+				// the whole subtree is already selected
+				break
+			}
+		}
+	}
+
+	return mask, nil
+}
+
+// add selects the element and returns its mask. returns nil if the whole
+// subtree of the element is selected
+func (m *fieldMask) add(e pathElement, last bool) *fieldMask {
+	if e.name != "" {
+		if m.fields == nil {
+			m.fields = make(map[string]*fieldMask)
+		}
+		return addMask(m.fields, e.name, last)
+	}
+
+	if m.items == nil {
+		m.items = make(map[int]*fieldMask)
+	}
+	return addMask(m.items, e.index, last)
+}
+
+func addMask[K comparable](children map[K]*fieldMask, key K, last bool) *fieldMask {
+	sub, ok := children[key]
+
+	switch {
+	case ok && sub == nil:
+		// the whole subtree is already selected
+		return nil
+	case last:
+		children[key] = nil
+		return nil
+	case !ok:
+		sub = &fieldMask{}
+		children[key] = sub
+	}
+
+	return sub
+}
+
+// root returns the mask function of the single item
+func (m *fieldMask) root() maskFunc {
+	if m == nil {
+		return nil
+	}
+
+	return func(int) (*fieldMask, bool) {
+		return m, true
+	}
+}
+
+// structFields returns the mask function of the fields of struct 'v' encoded
+// with field 'ids' (nil - positional)
+func (m *fieldMask) structFields(v reflect.Value, ids []uint64) maskFunc {
+	if m == nil {
+		return nil
+	}
+
+	si := getStructInfo(v.Type())
+	if si.ids == nil {
+		ids = nil
+	}
+
+	return func(i int) (*fieldMask, bool) {
+		k := i
+
+		if ids != nil {
+			var ok bool
+			if i >= len(ids) {
+				return nil, false
+			}
+			if k, ok = si.byid[ids[i]]; !ok {
+				return nil, false
+			}
+		}
+
+		if k >= len(si.fields) {
+			return nil, false
+		}
+
+		sub, ok := m.fields[si.fields[k].name]
+		return sub, ok
+	}
+}
+
+// arrayItems returns the mask function of the array items
+func (m *fieldMask) arrayItems() maskFunc {
+	if m == nil {
+		return nil
+	}
+
+	return func(i int) (*fieldMask, bool) {
+		sub, ok := m.items[i]
+		anysub, ok_any := m.items[-1]
+
+		switch {
+		case !ok_any:
+			return sub, ok
+		case !ok:
+			return anysub, true
+		}
+
+		return sub.merge(anysub), true
+	}
+}
+
+// valueItems returns the mask function of the items of generic Value. the
+// items are selected by position, the fields of struct with IDs - by ID
+func (m *fieldMask) valueItems(ids []uint64) maskFunc {
+	if m == nil {
+		return nil
+	}
+
+	items := m.arrayItems()
+	if ids == nil {
+		return items
+	}
+
+	return func(i int) (*fieldMask, bool) {
+		return items(int(ids[i]))
+	}
+}
+
+// merge returns the union of masks
+func (m *fieldMask) merge(m1 *fieldMask) *fieldMask {
+	if m == nil || m1 == nil {
+		return nil
+	}
+
+	return &fieldMask{
+		fields: mergeMasks(m.fields, m1.fields),
+		items:  mergeMasks(m.items, m1.items),
+	}
+}
+
+func mergeMasks[K comparable](a, b map[K]*fieldMask) map[K]*fieldMask {
+	if a == nil && b == nil {
+		return nil
+	}
+
+	u := make(map[K]*fieldMask, len(a)+len(b))
+	for k, sub := range a {
+		u[k] = sub
+	}
+	for k, sub := range b {
+		if s, ok := u[k]; ok {
+			sub = s.merge(sub)
+		}
+		u[k] = sub
+	}
+
+	return u
+}
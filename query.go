@@ -0,0 +1,233 @@
+// Golang support for LLSN - Allyst's data interchange format.
+// LLSN specification http://allyst.org/opensource/llsn/
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// copyright (C) 2015 Allyst Inc. http://allyst.com
+// author Taras Halturin <halturin@allyst.com>
+
+package llsn
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// Query returns the value at 'path' of the encoded packet. The packet is
+// walked with no decoding: the rest of values are skipped, tailed data are
+// read up to the selected value only. The packet has no field names, so the
+// names are resolved by the 'schema' (value of the packet's struct type) and
+// can't be used without it. The path of numbers needs no schema: the fields
+// are selected by position, or by ID for the struct with field IDs:
+//
+//	Query(packet, "2[2].1")
+//	Query(packet, "Items[2].Price", Order{})
+//
+// The null value on the path gives the null Value. Returns *ErrorLLSN with
+// ERR_NOT_FOUND code if the packet has no such value.
+func Query(packet []byte, path string, schema ...interface{}) (value Value, err error) {
+	var buffer decodeBuffer
+	var root Value
+
+	defer recoverError(&err)
+
+	q, err := newQuery(path, schema)
+	if err != nil {
+		return value, err
+	}
+
+	buffer.init_buffer(packet)
+	n := decodeHeader(&buffer)
+	q.wrap(n, buffer.look(1)[0])
+
+	tail := &tailElement{}
+	items := q.mask.valueItems(nil)
+
+	decode_loop(&buffer, n, makeItems(reflect.ValueOf(&root).Elem().FieldByName("Items"),
+		n, items), tail, items)
+	decodeTail(&buffer, selectedTail(tail))
+	decodeChecksum(&buffer)
+
+	return q.result(root), nil
+}
+
+// selectedTail drops the tail elements after the last one of selected value
+// and returns 'tail_first'. the rest of tailed data is not read then
+func selectedTail(tail_first *tailElement) *tailElement {
+	last := tail_first
+
+	for tail := tail_first.next; tail != nil; tail = tail.next {
+		if tail.value.IsValid() {
+			last = tail
+		}
+	}
+
+	last.next = nil
+	return tail_first
+}
+
+// query is the parsed path of Query
+type query struct {
+	path  string
+	t     reflect.Type // schema. nil - positional
+	mask  *fieldMask
+	depth int
+}
+
+func newQuery(path string, schema []interface{}) (*query, error) {
+	q := &query{path: path}
+
+	elements, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(schema) > 0 {
+		if q.t = derefType(reflect.TypeOf(schema[0])); q.t == nil || q.t.Kind() != reflect.Struct {
+			return nil, errors.New("Incorrect type of the schema (expect struct)")
+		}
+	}
+
+	if q.mask, err = queryMask(elements, q.t); err != nil {
+		return nil, err
+	}
+
+	q.depth = len(elements)
+	return q, nil
+}
+
+// wrap adjusts the path for the packet of 'n' fields with the first field
+// of 'first_type'
+func (q *query) wrap(n uint64, first_type byte) {
+	if n == 1 && first_type == type_structid && (q.t == nil || !wrapsIDs(q.t)) {
+		// struct with field IDs is encoded as the single field
+		q.mask = &fieldMask{items: map[int]*fieldMask{0: q.mask}}
+		q.depth++
+	}
+}
+
+// target sets the mask of the selected value. it's called before wrap
+func (q *query) target(m *fieldMask) {
+	mask := q.mask
+	for i := 1; i < q.depth; i++ {
+		for _, sub := range mask.items {
+			mask = sub
+		}
+	}
+
+	for k := range mask.items {
+		mask.items[k] = m
+	}
+}
+
+// field returns the number of selected top level field
+func (q *query) field() int {
+	for k := range q.mask.items {
+		return k
+	}
+	return -1
+}
+
+// result returns the selected value of decoded 'root'
+func (q *query) result(root Value) Value {
+	value := root
+
+	for i := 0; i < q.depth; i++ {
+		switch {
+		case value.Items == nil && value.Data == nil:
+			// null struct or array
+			return Value{}
+		case len(value.Items) == 0:
+			oops(ERR_NOT_FOUND, q.path)
+		}
+		value = value.Items[0]
+	}
+
+	return value
+}
+
+// queryMask builds the mask selecting the single value of generic Value.
+// field names are resolved by the struct type 't'
+func queryMask(elements []pathElement, t reflect.Type) (*fieldMask, error) {
+	var mask *fieldMask
+
+	keys := make([]int, len(elements))
+
+	for i, e := range elements {
+		switch {
+		case e.name == "" && e.index < 0:
+			return nil, errors.New("Query selects the single value. '[*]' is not allowed")
+
+		case e.name == "":
+			keys[i] = e.index
+			if t != nil {
+				if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+					return nil, fmt.Errorf("%s is not an array", t)
+				}
+				t = derefType(t.Elem())
+			}
+
+		case t == nil:
+			key, err := strconv.Atoi(e.name)
+			if err != nil || key < 0 {
+				return nil, fmt.Errorf("Field %q requires the schema", e.name)
+			}
+			keys[i] = key
+
+		default:
+			if t.Kind() != reflect.Struct {
+				return nil, fmt.Errorf("%s is not a struct", t)
+			}
+
+			si := getStructInfo(t)
+			k := -1
+			for j, f := range si.fields {
+				if f.name == e.name {
+					k = j
+					break
+				}
+			}
+
+			if k < 0 {
+				return nil, fmt.Errorf("%s has no field %s", t, e.name)
+			}
+
+			keys[i] = k
+			if si.ids != nil {
+				keys[i] = int(si.ids[k])
+			}
+			t = derefType(si.fields[k].t)
+		}
+	}
+
+	for i := len(keys) - 1; i >= 0; i-- {
+		mask = &fieldMask{items: map[int]*fieldMask{keys[i]: mask}}
+	}
+
+	return mask, nil
+}
+
+func derefType(t reflect.Type) reflect.Type {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
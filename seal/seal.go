@@ -0,0 +1,507 @@
+// Golang support for LLSN - Allyst's data interchange format.
+// LLSN specification http://allyst.org/opensource/llsn/
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// copyright (C) 2015 Allyst Inc. http://allyst.com
+// author Taras Halturin <halturin@allyst.com>
+
+// Package seal encrypts and authenticates LLSN packets. The packet is sealed
+// by chunks while it's encoded, so the huge files are never kept in memory.
+//
+// Sealed message:
+//
+// 4B   : "LLSE"
+// 1B   : version
+// 1B   : algorithm ID
+// 1B   : length of key ID
+// 0..n : key ID
+// 32B  : salt (random)
+// 7B   : nonce prefix (random)
+// chunks:
+// 4B   : length of sealed chunk (big-endian). the high bit marks the last one
+// ...  : sealed chunk (up to CHUNK_SIZE bytes of data and the tag)
+//
+// Every message is sealed with the key of its own, derived from the key and
+// the salt by HKDF-SHA256 (like STREAM of Tink does), so the nonces of chunks
+// never repeat under the same key whatever the number of messages is. Nonce
+// of the chunk is the prefix, number of chunk (4B, big-endian) and 1 for the
+// last chunk (1B). The header is the additional data of every chunk, so the
+// chunks can't be reordered, dropped or moved to another message.
+package seal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+
+	llsn "github.com/allyst/go-llsn"
+)
+
+// IDs of the algorithms
+const (
+	ALG_AES_GCM = 1 // key is 16, 24 or 32 bytes
+
+	// not built in. RegisterAlgorithm(ALG_CHACHA20_POLY1305, chacha20poly1305.New)
+	ALG_CHACHA20_POLY1305 = 2
+)
+
+const (
+	// max length of data in the chunk
+	CHUNK_SIZE = 65536
+
+	// version of the sealed message
+	VERSION = 1
+)
+
+const (
+	magic       = "LLSE"
+	salt_size   = 32
+	prefix_size = 7
+	nonce_size  = 12
+	last_flag   = 0x80000000
+)
+
+var (
+	ErrAuthentication = errors.New("seal: message authentication failed")
+	ErrFormat         = errors.New("seal: invalid message")
+)
+
+var algorithms = struct {
+	sync.RWMutex
+	ids map[uint8]func(key []byte) (cipher.AEAD, error)
+}{
+	ids: make(map[uint8]func(key []byte) (cipher.AEAD, error)),
+}
+
+// RegisterAlgorithm binds the AEAD constructor to the algorithm 'id'. The
+// nonce size of AEAD has to be 12 bytes. Panics if the ID is already
+// registered.
+func RegisterAlgorithm(id uint8, f func(key []byte) (cipher.AEAD, error)) {
+	algorithms.Lock()
+	defer algorithms.Unlock()
+
+	if _, exist := algorithms.ids[id]; exist {
+		panic(fmt.Sprintf("algorithm ID %d is already registered", id))
+	}
+
+	algorithms.ids[id] = f
+}
+
+func newAEAD(alg uint8, key []byte) (cipher.AEAD, error) {
+	algorithms.RLock()
+	f := algorithms.ids[alg]
+	algorithms.RUnlock()
+
+	if f == nil {
+		return nil, fmt.Errorf("seal: unsupported algorithm %d", alg)
+	}
+
+	aead, err := f(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if aead.NonceSize() != nonce_size {
+		return nil, fmt.Errorf("seal: nonce size of algorithm %d is not %d", alg, nonce_size)
+	}
+
+	return aead, nil
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func init() {
+	RegisterAlgorithm(ALG_AES_GCM, newAESGCM)
+}
+
+// messageKey derives the key of message with 'salt' from the 'key' of
+// algorithm 'alg'. the derived key has the same length
+func messageKey(alg uint8, key, salt []byte) ([]byte, error) {
+	return hkdf.Key(sha256.New, key, salt, magic+string([]byte{VERSION, alg}), len(key))
+}
+
+// chunkNonce returns the nonce of the chunk 'n' of the message with 'prefix'
+func chunkNonce(prefix []byte, n uint32, last bool) []byte {
+	nonce := make([]byte, nonce_size)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[prefix_size:], n)
+	if last {
+		nonce[nonce_size-1] = 1
+	}
+	return nonce
+}
+
+// Writer seals the data written to it as the single message
+type Writer struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	prefix  []byte
+	counter uint32
+	buf     []byte // data of the chunk in progress
+	out     []byte
+	err     error
+}
+
+// NewWriter writes the header of message to 'w' and returns the Writer
+// sealing the data with the 'key'. 'keyID' is written as is (up to 255 bytes)
+// to let the reader choose the key. Close writes the last chunk.
+func NewWriter(w io.Writer, alg uint8, key []byte, keyID string) (*Writer, error) {
+	if len(keyID) > math.MaxUint8 {
+		return nil, errors.New("seal: key ID is too long")
+	}
+
+	header := append([]byte(magic), VERSION, alg, byte(len(keyID)))
+	header = append(header, keyID...)
+
+	random := make([]byte, salt_size+prefix_size)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	header = append(header, random...)
+
+	mkey, err := messageKey(alg, key, random[:salt_size])
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(alg, mkey)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		w:      w,
+		aead:   aead,
+		header: header,
+		prefix: random[salt_size:],
+		buf:    make([]byte, 0, CHUNK_SIZE),
+		out:    make([]byte, 4, 4+CHUNK_SIZE+aead.Overhead()),
+	}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	var written int
+
+	for len(p) > 0 {
+		if w.err != nil {
+			return written, w.err
+		}
+
+		if len(w.buf) == CHUNK_SIZE {
+			// there are more data. the chunk isn't the last one
+			w.err = w.flush(false)
+			continue
+		}
+
+		n := min(CHUNK_SIZE-len(w.buf), len(p))
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+// Close writes the last chunk. It doesn't close the underlying writer
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+
+	err := w.flush(true)
+	w.err = errors.New("seal: writer is closed")
+	return err
+}
+
+func (w *Writer) flush(last bool) error {
+	if w.counter == math.MaxUint32 {
+		return errors.New("seal: message is too long")
+	}
+
+	sealed := w.aead.Seal(w.out[:4], chunkNonce(w.prefix, w.counter, last), w.buf, w.header)
+
+	length := uint32(len(sealed) - 4)
+	if last {
+		length |= last_flag
+	}
+	binary.BigEndian.PutUint32(sealed, length)
+
+	w.buf = w.buf[:0]
+	w.counter++
+
+	_, err := w.w.Write(sealed)
+	return err
+}
+
+// Reader opens the sealed message. The data are returned chunk by chunk once
+// the chunk is authenticated. The message is authentic if Read returns io.EOF.
+type Reader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	header  []byte
+	prefix  []byte
+	keyID   string
+	counter uint32
+	in      []byte
+	plain   []byte // the rest of data of the chunk
+	done    bool
+	err     error
+}
+
+// NewReader reads the header of message from 'r'. The 'keys' returns the key
+// by ID. The data after the message are not read.
+func NewReader(r io.Reader, keys func(keyID string) ([]byte, error)) (*Reader, error) {
+	head := make([]byte, len(magic)+3)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+
+	if string(head[:len(magic)]) != magic || head[len(magic)] != VERSION {
+		return nil, ErrFormat
+	}
+
+	alg := head[len(magic)+1]
+	rest := make([]byte, int(head[len(magic)+2])+salt_size+prefix_size)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+
+	random := rest[len(rest)-salt_size-prefix_size:]
+	keyID := string(rest[:len(rest)-len(random)])
+	key, err := keys(keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	mkey, err := messageKey(alg, key, random[:salt_size])
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(alg, mkey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reader{
+		r:      r,
+		aead:   aead,
+		header: append(head, rest...),
+		prefix: random[salt_size:],
+		keyID:  keyID,
+		in:     make([]byte, CHUNK_SIZE+aead.Overhead()),
+	}, nil
+}
+
+// KeyID returns the ID of the message key
+func (r *Reader) KeyID() string {
+	return r.keyID
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		switch {
+		case r.err != nil:
+			return 0, r.err
+		case r.done:
+			return 0, io.EOF
+		}
+
+		r.err = r.next()
+	}
+
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// next reads and opens the next chunk
+func (r *Reader) next() error {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(r.r, head); err != nil {
+		if err == io.EOF {
+			// the last chunk is missing
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	length := binary.BigEndian.Uint32(head)
+	last := length&last_flag > 0
+	length &^= last_flag
+
+	if length > uint32(len(r.in)) || (!last && r.counter == math.MaxUint32-1) {
+		return ErrFormat
+	}
+
+	sealed := r.in[:length]
+	if _, err := io.ReadFull(r.r, sealed); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	plain, err := r.aead.Open(sealed[:0], chunkNonce(r.prefix, r.counter, last), sealed, r.header)
+	if err != nil {
+		return ErrAuthentication
+	}
+
+	r.plain = plain
+	r.counter++
+	r.done = last
+	return nil
+}
+
+// Encoder writes the sealed LLSN packets
+type Encoder struct {
+	w     io.Writer
+	alg   uint8
+	key   []byte
+	keyID string
+}
+
+// NewEncoder returns the Encoder sealing the packets with the 'key'
+func NewEncoder(w io.Writer, alg uint8, key []byte, keyID string) (*Encoder, error) {
+	if _, err := newAEAD(alg, key); err != nil {
+		return nil, err
+	}
+
+	return &Encoder{w, alg, key, keyID}, nil
+}
+
+// Encode encodes 'v' (see llsn.Encode) and writes the packet as the sealed
+// message
+func (e *Encoder) Encode(v interface{}) error {
+	w, err := NewWriter(e.w, e.alg, e.key, e.keyID)
+	if err != nil {
+		return err
+	}
+
+	channel := make(chan []byte)
+	failure := make(chan interface{}, 1)
+
+	go func() {
+		// llsn.Encode closes the channel even if it fails
+		defer func() { failure <- recover() }()
+		llsn.Encode(v, channel)
+	}()
+
+	for b := range channel {
+		if err == nil {
+			_, err = w.Write(b)
+		}
+	}
+
+	if r := <-failure; r != nil {
+		return fmt.Errorf("seal: %v", r)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return w.Close()
+}
+
+// Decoder reads the sealed LLSN packets
+type Decoder struct {
+	r     io.Reader
+	keys  func(keyID string) ([]byte, error)
+	keyID string
+}
+
+// NewDecoder returns the Decoder of the messages read from 'r'. The 'keys'
+// returns the key by ID
+func NewDecoder(r io.Reader, keys func(keyID string) ([]byte, error)) *Decoder {
+	return &Decoder{r: r, keys: keys}
+}
+
+// KeyID returns the key ID of the last message
+func (d *Decoder) KeyID() string {
+	return d.keyID
+}
+
+// Decode opens the next message and decodes its packet into 'v' (see
+// llsn.Decode). The chunks are decoded once they are authenticated, so 'v'
+// could be filled partially if the message is not authentic.
+func (d *Decoder) Decode(v interface{}) error {
+	var failure error
+
+	r, err := NewReader(d.r, d.keys)
+	if err != nil {
+		return err
+	}
+	d.keyID = r.KeyID()
+
+	channel := make(chan []byte)
+
+	go func() {
+		defer close(channel)
+
+		for {
+			// decoder keeps the received data
+			buf := make([]byte, CHUNK_SIZE)
+
+			n, err := r.Read(buf)
+			if n > 0 {
+				channel <- buf[:n]
+			}
+
+			if err != nil {
+				if err != io.EOF {
+					failure = err
+				}
+				return
+			}
+		}
+	}()
+
+	err = llsn.Decode(channel, v)
+
+	// the rest of message has to be authenticated as well
+	for range channel {
+	}
+
+	if failure != nil {
+		return failure
+	}
+
+	return err
+}
@@ -0,0 +1,186 @@
+// Golang support for LLSN - Allyst's data interchange format.
+// LLSN specification http://allyst.org/opensource/llsn/
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// copyright (C) 2015 Allyst Inc. http://allyst.com
+// author Taras Halturin <halturin@allyst.com>
+
+package seal_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	llsn "github.com/allyst/go-llsn"
+	"github.com/allyst/go-llsn/seal"
+)
+
+type ExampleDocument struct {
+	ID      int64
+	Title   string
+	Content llsn.Blob
+}
+
+func TestSeal(t *testing.T) {
+	var sealed bytes.Buffer
+
+	keys := map[string][]byte{"k1": make([]byte, 32), "k2": make([]byte, 16)}
+	rand.Read(keys["k1"])
+	rand.Read(keys["k2"])
+
+	lookup := func(id string) ([]byte, error) {
+		if key, ok := keys[id]; ok {
+			return key, nil
+		}
+		return nil, errors.New("unknown key " + id)
+	}
+
+	// the content takes several chunks
+	content := make([]byte, 3*seal.CHUNK_SIZE+100)
+	rand.Read(content)
+
+	docs := []ExampleDocument{
+		{1, "first", llsn.Blob(content)},
+		{2, strings.Repeat("long title ", 10), nil},
+	}
+
+	llsn.SetOption("threshold", 64)
+	defer llsn.SetOption("threshold", 0)
+
+	e1, err := seal.NewEncoder(&sealed, seal.ALG_AES_GCM, keys["k1"], "k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e2, err := seal.NewEncoder(&sealed, seal.ALG_AES_GCM, keys["k2"], "k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e1.Encode(&docs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := e2.Encode(&docs[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(sealed.Bytes(), []byte("long title")) {
+		t.Fatalf("data are not encrypted")
+	}
+
+	b := sealed.Bytes()
+	d := seal.NewDecoder(bytes.NewReader(b), lookup)
+
+	for i, doc := range docs {
+		var D ExampleDocument
+		if err := d.Decode(&D); err != nil {
+			t.Fatal(err)
+		}
+		if D.ID != doc.ID || D.Title != doc.Title || !bytes.Equal(D.Content, doc.Content) {
+			t.Fatalf("document %d: %d %q", i, D.ID, D.Title)
+		}
+		if d.KeyID() != fmt.Sprintf("k%d", i+1) {
+			t.Fatalf("key ID %q", d.KeyID())
+		}
+	}
+
+	var D ExampleDocument
+	if err := d.Decode(&D); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	// tampered message
+	c := append([]byte{}, b...)
+	c[len(c)/2]++
+	if err := seal.NewDecoder(bytes.NewReader(c), lookup).Decode(&D); err != seal.ErrAuthentication {
+		t.Fatalf("expected %v, got %v", seal.ErrAuthentication, err)
+	}
+
+	// truncated message
+	r, err := seal.NewReader(bytes.NewReader(b[:2*seal.CHUNK_SIZE]), lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+
+	// the last chunk of message is moved to the other one
+	var m1, m2 bytes.Buffer
+	for _, m := range []*bytes.Buffer{&m1, &m2} {
+		w, err := seal.NewWriter(m, seal.ALG_AES_GCM, keys["k1"], "k1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("data"))
+		w.Close()
+	}
+
+	header := m1.Len() - 4 - 4 - 16
+	c = append(m1.Bytes()[:header:header], m2.Bytes()[header:]...)
+	r, _ = seal.NewReader(bytes.NewReader(c), lookup)
+	if _, err := io.ReadAll(r); err != seal.ErrAuthentication {
+		t.Fatalf("expected %v, got %v", seal.ErrAuthentication, err)
+	}
+
+	// every message has the key of its own. the salt of the other message
+	// doesn't open it
+	salt := len(m1.Bytes()) - 4 - 4 - 16 - 7 - 32
+	c = append(append(append([]byte{}, m1.Bytes()[:salt]...), m2.Bytes()[salt:salt+32]...),
+		m1.Bytes()[salt+32:]...)
+	if bytes.Equal(c, m1.Bytes()) {
+		t.Fatalf("messages have the same salt")
+	}
+	r, _ = seal.NewReader(bytes.NewReader(c), lookup)
+	if _, err := io.ReadAll(r); err != seal.ErrAuthentication {
+		t.Fatalf("expected %v, got %v", seal.ErrAuthentication, err)
+	}
+
+	// failed encoding gives the error
+	if err := e1.Encode(&struct{ M map[string]int }{}); err == nil {
+		t.Fatalf("expected error for unsupported type")
+	}
+	if err := e1.Encode(&docs[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	// unknown key
+	if _, err := seal.NewReader(bytes.NewReader(b), func(string) ([]byte, error) {
+		return nil, errors.New("no keys")
+	}); err == nil {
+		t.Fatalf("expected error for unknown key")
+	}
+
+	// wrong key size
+	if _, err := seal.NewEncoder(&sealed, seal.ALG_AES_GCM, []byte("short"), "k"); err == nil {
+		t.Fatalf("expected error for the wrong key")
+	}
+
+	// chacha20-poly1305 is not built in
+	if _, err := seal.NewEncoder(&sealed, seal.ALG_CHACHA20_POLY1305, keys["k1"], "k1"); err == nil {
+		t.Fatalf("expected error for the unregistered algorithm")
+	}
+
+	fmt.Printf("TestSeal: PASSED\n")
+}
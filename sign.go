@@ -0,0 +1,107 @@
+// Golang support for LLSN - Allyst's data interchange format.
+// LLSN specification http://allyst.org/opensource/llsn/
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// copyright (C) 2015 Allyst Inc. http://allyst.com
+// author Taras Halturin <halturin@allyst.com>
+
+package llsn
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"reflect"
+)
+
+// Canonical encoding is the deterministic form of packet: the same value
+// gives the same bytes regardless of options and the way it was obtained
+// (e.g. decoded and encoded back). It's the base of signatures.
+//
+// - no threshold and tailed data, the header of version 2 only for the type
+//   codes of version 2 (see header.go)
+// - no compression, checksum, digests and index
+// - dates are DATE_LOSSLESS in UTC (the instant is kept, the zone is not)
+// - fields of struct with IDs are written in declaration order
+//
+// Maps are not supported by the encoder, Canonical returns the error for
+// the types with no deterministic encoding. The "flatten" option changes the
+// layout of struct, so it has to be the same on both sides.
+
+// Canonical returns the canonical encoding of 'v'
+func Canonical(v interface{}) (b []byte, err error) {
+	value := reflect.ValueOf(v)
+
+	if !value.IsValid() || (value.Kind() == reflect.Ptr && value.IsNil()) {
+		return nil, errors.New("Incorrect source (nil)")
+	}
+
+	if value.Kind() == reflect.Ptr {
+		value = value.Elem()
+	}
+
+	if err := func() (err error) {
+		defer recoverEncode(&err)
+		return checkType(value.Type(), map[reflect.Type]bool{})
+	}(); err != nil {
+		return nil, err
+	}
+
+	func() {
+		defer recoverEncode(&err)
+		b = encodeBytes(func(w io.Writer) {
+			encode_ext(value, w, 0, true)
+		})
+	}()
+
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Sign returns the ed25519 signature of canonical encoding of 'v'
+func Sign(v interface{}, key ed25519.PrivateKey) ([]byte, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, errors.New("Incorrect private key")
+	}
+
+	b, err := Canonical(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return ed25519.Sign(key, b), nil
+}
+
+// Verify reports whether 'signature' is the valid signature of 'v' made by
+// the owner of 'key'. returns the error if 'v' can't be encoded
+func Verify(v interface{}, signature []byte, key ed25519.PublicKey) (bool, error) {
+	if len(key) != ed25519.PublicKeySize {
+		return false, errors.New("Incorrect public key")
+	}
+
+	b, err := Canonical(v)
+	if err != nil {
+		return false, err
+	}
+
+	return ed25519.Verify(key, b, signature), nil
+}
@@ -0,0 +1,338 @@
+// Golang support for LLSN - Allyst's data interchange format.
+// LLSN specification http://allyst.org/opensource/llsn/
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// copyright (C) 2015 Allyst Inc. http://allyst.com
+// author Taras Halturin <halturin@allyst.com>
+
+package llsn
+
+import (
+	"errors"
+	"iter"
+	"reflect"
+)
+
+// Stream is the array field of unknown length. The elements are taken from
+// the iterator on encoding and passed to the callback one by one on decoding,
+// so the whole array is never kept in memory.
+//
+// Encoded stream:
+//
+// 1B   : type_stream
+// chunks:
+// 1..9B: number of elements in chunk (UNUMBER). 0 - end of stream
+// 1B   : nullflags (every 8 elements)
+// ...  : elements
+//
+// types of elements are written once like the types of array items. Tail
+// encoding is disabled for the elements. Zero Stream is encoded as the
+// empty one. Stream can be decoded into the slice or Value as well.
+type Stream[T any] struct {
+	seq  iter.Seq[T]
+	each func(T) error
+}
+
+// NewStream returns the Stream encoding the elements of 'seq'
+func NewStream[T any](seq iter.Seq[T]) Stream[T] {
+	return Stream[T]{seq: seq}
+}
+
+// StreamFunc returns the Stream passing the decoded elements to 'f'. The
+// error of 'f' stops decoding and is returned by Decode
+func StreamFunc[T any](f func(T) error) Stream[T] {
+	return Stream[T]{each: f}
+}
+
+// DecodeArray passes the elements of array (or stream) at 'path' to 'f' one by
+// one as they are parsed, so the array is never kept in memory. The path
+// selects the value like Query does, the rest of packet is skipped. The
+// source is '[]byte' or 'chan []byte'. The null elements are passed as the
+// zero values. The error of 'f' stops decoding and is returned as is.
+//
+// The elements with tailed data (huge strings, blobs and files) are passed
+// when the tail is read, the ones after them are queued to keep the order.
+// Encode with no threshold to process the array in constant memory.
+func DecodeArray[T any](source interface{}, path string, f func(*T) error,
+	schema ...interface{}) (err error) {
+
+	var buffer decodeBuffer
+	var root Value
+
+	defer recoverError(&err)
+
+	q, err := newQuery(path, schema)
+	if err != nil {
+		return err
+	}
+
+	if err := buffer.init_source(source); err != nil {
+		return err
+	}
+
+	sink := &streamLevel{elem: reflect.TypeOf((*T)(nil)).Elem()}
+	sink.put = func(v reflect.Value) {
+		e := new(T)
+		if v.CanAddr() {
+			e = v.Addr().Interface().(*T)
+		}
+		callback(func() error { return f(e) })
+	}
+	q.target(&fieldMask{sink: sink})
+
+	n := decodeHeader(&buffer)
+	q.wrap(n, buffer.look(1)[0])
+
+	tail := &tailElement{}
+	items := q.mask.valueItems(nil)
+
+	decode_loop(&buffer, n, makeItems(reflect.ValueOf(&root).Elem().FieldByName("Items"),
+		n, items), tail, items)
+	decodeTail(&buffer, tail)
+	decodeChecksum(&buffer)
+	buffer.skipIndex()
+	sink.release()
+
+	if v := q.result(root); !sink.used {
+		switch v.Type {
+		case 0, TYPE_ARRAY, TYPE_ARRAYN, TYPE_STREAM:
+			// null array
+		default:
+			oops(ERR_TYPE_MISMATCH, path+" is not an array")
+		}
+	}
+
+	return nil
+}
+
+// Elements returns the iterator over the elements of array at 'path' (see
+// DecodeArray). The error is yielded last with nil element:
+//
+//	for row, err := range llsn.Elements[Row](packet, "Rows", Export{}) {
+//		...
+//	}
+func Elements[T any](source interface{}, path string, schema ...interface{}) iter.Seq2[*T, error] {
+	return func(yield func(*T, error) bool) {
+		err := DecodeArray(source, path, func(e *T) error {
+			if !yield(e, nil) {
+				return errBreak
+			}
+			return nil
+		}, schema...)
+
+		if err != nil && err != errBreak {
+			yield(nil, err)
+		}
+	}
+}
+
+// errBreak stops DecodeArray when the loop over Elements is broken
+var errBreak = errors.New("break")
+
+// streamer is implemented by all Stream types
+type streamer interface {
+	elemType() reflect.Type
+	chunks() (next func() reflect.Value, stop func())
+	putFunc() func(reflect.Value)
+}
+
+var streamerType = reflect.TypeOf((*streamer)(nil)).Elem()
+
+func (s Stream[T]) elemType() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
+
+// chunks returns the function reading the next chunk of elements (slice of T)
+// and the function releasing the iterator. the empty chunk is the end of
+// stream
+func (s Stream[T]) chunks() (func() reflect.Value, func()) {
+	if s.seq == nil {
+		return func() reflect.Value {
+			return reflect.ValueOf([]T{})
+		}, func() {}
+	}
+
+	next, stop := iter.Pull(s.seq)
+
+	return func() reflect.Value {
+		// tailed data refer to the elements, so the chunk isn't reused
+		chunk := make([]T, 0, STREAM_CHUNK)
+
+		for len(chunk) < STREAM_CHUNK {
+			v, ok := next()
+			if !ok {
+				stop()
+				break
+			}
+			chunk = append(chunk, v)
+		}
+
+		return reflect.ValueOf(chunk)
+	}, stop
+}
+
+func (s Stream[T]) putFunc() func(reflect.Value) {
+	if s.each == nil {
+		return nil
+	}
+
+	return func(v reflect.Value) {
+		callback(func() error { return s.each(v.Interface().(T)) })
+	}
+}
+
+// callbackError is the error of user's callback. it's returned as is
+type callbackError struct {
+	err error
+}
+
+// callbackPanic is the panic of user's callback (or the body of loop over
+// Elements). it's not turned into the error, the decoder panics with 'value'
+type callbackPanic struct {
+	value interface{}
+}
+
+// callback runs the user's callback 'f'
+func callback(f func() error) {
+	err := func() error {
+		defer func() {
+			if r := recover(); r != nil {
+				panic(&callbackPanic{r})
+			}
+		}()
+		return f()
+	}()
+
+	if err != nil {
+		panic(&callbackError{err})
+	}
+}
+
+// streamLevel is the state of the stream being encoded or decoded. It's
+// used as the sink of array items as well (see DecodeArray)
+type streamLevel struct {
+	next    func() reflect.Value // encoding. next chunk
+	elem    reflect.Type         // decoding. type of elements
+	put     func(reflect.Value)  // decoding. nil - discard elements
+	pending reflect.Value        // decoding. the element in progress
+	tail    *tailElement         // tail of the parent
+	chunked bool                 // stream. false - array
+
+	// the elements with tailed data are queued until the tail is read
+	tailp **tailElement // tail of decode_loop
+	mark  *tailElement  // tail before the pending element
+	queue []reflect.Value
+	used  bool
+}
+
+// newStreamLevel prepares the decoding of stream into 'field'
+func newStreamLevel(field reflect.Value, tail *tailElement) *streamLevel {
+	s := &streamLevel{tail: tail, chunked: true}
+
+	if !field.IsValid() {
+		return s
+	}
+
+	if field.Kind() == reflect.Ptr {
+		field.Set(reflect.New(field.Type().Elem()))
+		field = field.Elem()
+	}
+
+	if field.Type().Implements(streamerType) {
+		st := field.Interface().(streamer)
+		s.elem = st.elemType()
+		s.put = st.putFunc()
+		return s
+	}
+
+	// slice
+	s.elem = field.Type().Elem()
+	field.Set(reflect.MakeSlice(field.Type(), 0, 0))
+	s.put = func(v reflect.Value) {
+		field.Set(reflect.Append(field, v))
+	}
+
+	return s
+}
+
+// attach makes the sink the level of stream ('chunked') or array being
+// decoded. 'tail' is the tail variable of decode_loop
+func (s *streamLevel) attach(tail **tailElement, chunked bool) *streamLevel {
+	s.tail = *tail
+	s.tailp = tail
+	s.chunked = chunked
+	s.used = true
+	return s
+}
+
+// item returns the destination of the next element
+func (s *streamLevel) item(int) reflect.Value {
+	s.flush()
+
+	if s.put == nil {
+		return reflect.Value{}
+	}
+
+	if s.tailp != nil {
+		s.mark = *s.tailp
+	}
+
+	s.pending = reflect.New(s.elem).Elem()
+	return s.pending
+}
+
+// null passes the null element
+func (s *streamLevel) null() {
+	s.flush()
+
+	if s.put != nil {
+		s.deliver(reflect.Zero(s.elem), false)
+	}
+}
+
+// flush passes the decoded element
+func (s *streamLevel) flush() {
+	if s.pending.IsValid() {
+		v := s.pending
+		s.pending = reflect.Value{}
+		s.deliver(v, s.tailp != nil && *s.tailp != s.mark)
+	}
+}
+
+// deliver passes the element 'v'. the element with tailed data and the ones
+// after it are queued to keep the order
+func (s *streamLevel) deliver(v reflect.Value, tailed bool) {
+	if tailed || len(s.queue) > 0 {
+		s.queue = append(s.queue, v)
+		return
+	}
+
+	s.put(v)
+}
+
+// release passes the queued elements. It's called when the tail is read
+func (s *streamLevel) release() {
+	queue := s.queue
+	s.queue = nil
+
+	for _, v := range queue {
+		s.put(v)
+	}
+}
@@ -0,0 +1,131 @@
+// Golang support for LLSN - Allyst's data interchange format.
+// LLSN specification http://allyst.org/opensource/llsn/
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// copyright (C) 2015 Allyst Inc. http://allyst.com
+// author Taras Halturin <halturin@allyst.com>
+
+package llsn
+
+import (
+	"math/big"
+	"reflect"
+	"time"
+)
+
+// Value is a generic form of the decoded data. It is used for the data with
+// no Go type to decode into (values of unregistered interface types).
+//
+// Data holds the value of scalar types:
+//
+//	TYPE_NUMBER              int64
+//	TYPE_UNUMBER             uint64
+//	TYPE_FLOAT               float64
+//	TYPE_BOOL                bool
+//	TYPE_STRING              string
+//	TYPE_DATE, TYPE_NDATE    time.Time
+//	TYPE_BLOB                Blob
+//	TYPE_FILE                *File
+//	TYPE_BIGNUMBER           *big.Int
+//	TYPE_BIGFLOAT            *big.Float
+//	TYPE_EXT                 value of registered extension (Blob if unknown)
+//	TYPE_INTERFACE           value of registered type or Value
+//
+// Items holds the fields of struct and the items of array. Items of
+// TYPE_STRUCTID (struct with field IDs) are in order of encoding.
+type Value struct {
+	Type  int
+	Name  string // registered type name of the interface value
+	Data  interface{}
+	Items []Value
+}
+
+// IsNull returns true for the null values
+func (v *Value) IsNull() bool {
+	return v.Data == nil && v.Items == nil
+}
+
+var valueType = reflect.TypeOf(Value{})
+var itemsType = reflect.TypeOf([]Value{})
+
+// Go types for decoding the scalar data of Value
+var valueTypes = map[int]reflect.Type{
+	type_number:         reflect.TypeOf(int64(0)),
+	type_number_null:    reflect.TypeOf((*int64)(nil)),
+	type_unumber:        reflect.TypeOf(uint64(0)),
+	type_unumber_null:   reflect.TypeOf((*uint64)(nil)),
+	type_float:          reflect.TypeOf(float64(0)),
+	type_float_null:     reflect.TypeOf((*float64)(nil)),
+	type_bool:           reflect.TypeOf(false),
+	type_bool_null:      reflect.TypeOf((*bool)(nil)),
+	type_string:         reflect.TypeOf(""),
+	type_string_null:    reflect.TypeOf((*string)(nil)),
+	type_date:           reflect.TypeOf(time.Time{}),
+	type_date_null:      reflect.TypeOf((*time.Time)(nil)),
+	type_ndate:          reflect.TypeOf(time.Time{}),
+	type_ndate_null:     reflect.TypeOf((*time.Time)(nil)),
+	type_blob:           reflect.TypeOf(Blob{}),
+	type_blob_null:      reflect.TypeOf(Blob{}),
+	type_file:           reflect.TypeOf((*File)(nil)),
+	type_file_null:      reflect.TypeOf((*File)(nil)),
+	type_bignumber:      reflect.TypeOf((*big.Int)(nil)),
+	type_bignumber_null: reflect.TypeOf((*big.Int)(nil)),
+	type_bigfloat:       reflect.TypeOf((*big.Float)(nil)),
+	type_bigfloat_null:  reflect.TypeOf((*big.Float)(nil)),
+	type_ext:            reflect.TypeOf((*interface{})(nil)).Elem(),
+	type_ext_null:       reflect.TypeOf((*interface{})(nil)).Elem(),
+	type_interface:      reflect.TypeOf((*interface{})(nil)).Elem(),
+	type_interface_null: reflect.TypeOf((*interface{})(nil)).Elem(),
+}
+
+// valueField prepares the Value for decoding the data of 'value_type' and
+// returns the field to decode into
+func valueField(v reflect.Value, value_type int) reflect.Value {
+	// null types are "reversed" (type_number_null = 255 - type_number)
+	if value_type > type_last {
+		v.FieldByName("Type").SetInt(int64(255 - value_type))
+	} else {
+		v.FieldByName("Type").SetInt(int64(value_type))
+	}
+
+	if t, ok := valueTypes[value_type]; ok {
+		return reflect.New(t).Elem()
+	}
+
+	// struct, array
+	return v.FieldByName("Items")
+}
+
+// setValueData puts the decoded scalar into the Value
+func setValueData(v reflect.Value, field reflect.Value) {
+	switch field.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if field.IsNil() {
+			return
+		}
+	case reflect.Slice:
+		// Items of struct and array are decoded in place
+		if field.IsNil() || field.Type() == itemsType {
+			return
+		}
+	}
+
+	v.FieldByName("Data").Set(field)
+}
@@ -0,0 +1,182 @@
+// Golang support for LLSN - Allyst's data interchange format.
+// LLSN specification http://allyst.org/opensource/llsn/
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// copyright (C) 2015 Allyst Inc. http://allyst.com
+// author Taras Halturin <halturin@allyst.com>
+
+package llsn
+
+import (
+	"bytes"
+	"hash"
+	"io"
+	"sync"
+)
+
+// The encoder writes the data to io.Writer. Encode(v) writes them straight
+// into the buffer taken from the pool, Encode(v, channel) coalesces them into
+// the chunks of "chunk" option size. The chunk is sent before the next chunk
+// of Stream is taken as well, so the slow producer doesn't hold the data
+// encoded already (the compressed data are held by the compressor though).
+// The writers of encoder never fail, the errors are panics.
+
+// buffers of Encode. see Release
+var buffers = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// the buffers grown over this size are not pooled
+const pool_maxbytes = 1 << 20 // 1M
+
+func getBuffer() *bytes.Buffer {
+	b := buffers.Get().(*bytes.Buffer)
+	b.Reset()
+	return b
+}
+
+// Release returns the buffer of Encode to the pool. Neither the buffer nor
+// the data taken from it can be used after.
+func Release(b *bytes.Buffer) {
+	if b == nil || b.Cap() > pool_maxbytes {
+		return
+	}
+	buffers.Put(b)
+}
+
+// encodeBytes encodes with the pooled buffer and returns the copy of data
+func encodeBytes(encode func(w io.Writer)) []byte {
+	b := getBuffer()
+	defer Release(b)
+
+	encode(b)
+	return append([]byte(nil), b.Bytes()...)
+}
+
+// chunkWriter sends the data to the channel by chunks of 'size' bytes (the
+// last one is sent by flush). the chunks are never reused, the receiver owns
+// them
+type chunkWriter struct {
+	channel chan []byte
+	size    int
+	chunk   []byte
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	if c.size <= 1 {
+		c.channel <- append([]byte(nil), p...)
+		return len(p), nil
+	}
+
+	if len(c.chunk)+len(p) > c.size {
+		c.flush()
+
+		if len(p) >= c.size {
+			// it's long enough to be the chunk of its own
+			c.channel <- append([]byte(nil), p...)
+			return len(p), nil
+		}
+	}
+
+	if c.chunk == nil {
+		c.chunk = make([]byte, 0, c.size)
+	}
+	c.chunk = append(c.chunk, p...)
+	return len(p), nil
+}
+
+func (c *chunkWriter) flush() {
+	if len(c.chunk) > 0 {
+		c.channel <- c.chunk
+		c.chunk = nil
+	}
+}
+
+// flusher sends the data written so far (see chunkWriter)
+type flusher interface {
+	flush()
+}
+
+// flushWriter flushes 'w' if it's able to
+func flushWriter(w io.Writer) {
+	if f, ok := w.(flusher); ok {
+		f.flush()
+	}
+}
+
+// countWriter counts the bytes written to 'w'
+type countWriter struct {
+	w io.Writer
+	n uint64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	c.n += uint64(len(p))
+	return c.w.Write(p)
+}
+
+func (c *countWriter) flush() {
+	flushWriter(c.w)
+}
+
+func (c *countWriter) skip(n uint64) bool {
+	if s, ok := c.w.(skipWriter); ok && s.skip(n) {
+		c.n += n
+		return true
+	}
+	return false
+}
+
+// skipWriter takes the number of bytes instead of the data, if it's able to.
+// the file data aren't read then
+type skipWriter interface {
+	io.Writer
+	skip(n uint64) bool
+}
+
+// sizeWriter counts the bytes of packet and drops them (see Size)
+type sizeWriter struct {
+	n uint64
+}
+
+func (s *sizeWriter) Write(p []byte) (int, error) {
+	s.n += uint64(len(p))
+	return len(p), nil
+}
+
+func (s *sizeWriter) skip(n uint64) bool {
+	s.n += n
+	return true
+}
+
+// hashWriter passes the data written to 'w' to the hash
+type hashWriter struct {
+	w io.Writer
+	h hash.Hash
+}
+
+func (h hashWriter) Write(p []byte) (int, error) {
+	h.h.Write(p)
+	return h.w.Write(p)
+}
+
+func (h hashWriter) flush() {
+	flushWriter(h.w)
+}